@@ -0,0 +1,240 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore stores attachment content. Implementations must be safe for concurrent use.
+type BlobStore interface {
+	// Put stores everything read from r and returns the key it is stored under.
+	Put(filename, contentType string, r io.Reader) (key string, err error)
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// FileBlobStore stores blobs as files in Dir, named by random keys.
+type FileBlobStore struct {
+	Dir string
+}
+
+// NewFileBlobStore creates the directory if needed.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{Dir: dir}, nil
+}
+
+var errInvalidBlobKey = errors.New("smtpd: invalid blob key")
+
+// Put implements BlobStore. Content is written to a temporary file first, so
+// a failed Put never leaves a partial blob behind.
+func (fs *FileBlobStore) Put(filename, contentType string, r io.Reader) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(b)
+
+	tmp, err := ioutil.TempFile(fs.Dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(fs.Dir, key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return key, nil
+}
+
+// Open implements BlobStore.
+func (fs *FileBlobStore) Open(key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, errInvalidBlobKey
+	}
+	return os.Open(filepath.Join(fs.Dir, key))
+}
+
+// Delete implements BlobStore.
+func (fs *FileBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return errInvalidBlobKey
+	}
+	return os.Remove(filepath.Join(fs.Dir, key))
+}
+
+// Keys are generated by Put, anything else could point outside Dir.
+func validBlobKey(key string) bool {
+	return key != "" && strings.Trim(key, "0123456789abcdef") == ""
+}
+
+// Attachment describes an attachment stored in a BlobStore.
+type Attachment struct {
+	Key         string // Key in the BlobStore
+	Filename    string
+	ContentType string
+	ContentID   string
+	Inline      bool // Content-Disposition is inline, e.g. an image shown in the HTML part
+	Size        int64
+}
+
+// Manifest is the text of a message and the attachments extracted from it.
+type Manifest struct {
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+var (
+	errAttachmentTooLarge  = &Error{Code: 552, EnhancedCode: "5.3.4", Message: "Attachment exceeds size limit"}
+	errAttachmentsTooLarge = &Error{Code: 552, EnhancedCode: "5.3.4", Message: "Attachments exceed total size limit"}
+)
+
+// AttachmentExtractor walks every MIME part of a message, decoding transfer
+// encodings and filenames, and streams attachments into a BlobStore. Limits
+// that are exceeded are reported as *Error replies.
+type AttachmentExtractor struct {
+	Store             BlobStore
+	MaxAttachmentSize int64 // Maximum decoded size of a single attachment, 0 for no limit
+	MaxTotalSize      int64 // Maximum decoded size of all attachments together, 0 for no limit
+	MaxParts          int   // Maximum number of MIME parts, defaults to 100
+	MaxDepth          int   // Maximum multipart nesting, defaults to 10
+}
+
+// Extract stores the attachments of the message and returns its manifest.
+// On error the attachments already stored are deleted.
+func (x *AttachmentExtractor) Extract(msg io.Reader) (manifest *Manifest, err error) {
+	w := &mimeWalker{MaxParts: x.MaxParts, MaxDepth: x.MaxDepth}
+	if w.MaxParts == 0 {
+		w.MaxParts = 100
+	}
+	if w.MaxDepth == 0 {
+		w.MaxDepth = 10
+	}
+
+	manifest = &Manifest{}
+	defer func() {
+		if err != nil {
+			x.remove(manifest)
+			manifest = nil
+		}
+	}()
+
+	var total int64
+	err = w.walkMessage(msg, func(p *mimePart) error {
+		// The first text and HTML parts are the message, everything else is attached.
+		if !p.Attachment() && (p.MediaType == "text/plain" && manifest.Text == "" || p.MediaType == "text/html" && manifest.HTML == "") {
+			b, err := ioutil.ReadAll(p.Body)
+			if err != nil {
+				return err
+			}
+			if p.MediaType == "text/plain" {
+				manifest.Text = string(b)
+			} else {
+				manifest.HTML = string(b)
+			}
+			return nil
+		}
+
+		r := &limitedReader{R: p.Body, N: x.limit(total), Err: x.limitErr(total)}
+		key, err := x.Store.Put(p.Filename, p.MediaType, r)
+		if err != nil {
+			// The reader's error is more useful than however the store wrapped it.
+			if r.failed {
+				return r.Err
+			}
+			return err
+		}
+		total += r.read
+		manifest.Attachments = append(manifest.Attachments, Attachment{
+			Key:         key,
+			Filename:    p.Filename,
+			ContentType: p.MediaType,
+			ContentID:   strings.Trim(p.Header.Get("Content-Id"), "<>"),
+			Inline:      p.Disposition == "inline",
+			Size:        r.read,
+		})
+		return nil
+	})
+	return manifest, err
+}
+
+// HandlerMessage returns a HandlerMessage that extracts the attachments of every
+// message and passes the manifest to fn. If fn fails the message is rejected or
+// retried, so its attachments are deleted again.
+func (x *AttachmentExtractor) HandlerMessage(fn func(env *Envelope, manifest *Manifest) error) HandlerMessage {
+	return func(env *Envelope, msg io.Reader) error {
+		manifest, err := x.Extract(msg)
+		if err != nil {
+			return err
+		}
+		err = fn(env, manifest)
+		if err != nil {
+			x.remove(manifest)
+		}
+		return err
+	}
+}
+
+// Delete the attachments of the manifest from the store.
+func (x *AttachmentExtractor) remove(manifest *Manifest) {
+	for _, a := range manifest.Attachments {
+		x.Store.Delete(a.Key)
+	}
+}
+
+// Bytes the next part may have, -1 for no limit.
+func (x *AttachmentExtractor) limit(total int64) int64 {
+	n := int64(-1)
+	if x.MaxAttachmentSize > 0 {
+		n = x.MaxAttachmentSize
+	}
+	if x.MaxTotalSize > 0 && (n == -1 || x.MaxTotalSize-total < n) {
+		n = x.MaxTotalSize - total
+	}
+	return n
+}
+
+// Error for the limit returned by limit.
+func (x *AttachmentExtractor) limitErr(total int64) error {
+	if x.MaxTotalSize > 0 && (x.MaxAttachmentSize == 0 || x.MaxTotalSize-total < x.MaxAttachmentSize) {
+		return errAttachmentsTooLarge
+	}
+	return errAttachmentTooLarge
+}
+
+// limitedReader fails with Err when more than N bytes are read, rather than
+// silently truncating like io.LimitReader. N < 0 means no limit.
+type limitedReader struct {
+	R      io.Reader
+	N      int64
+	Err    error
+	read   int64
+	failed bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.R.Read(p)
+	l.read += int64(n)
+	if l.N >= 0 && l.read > l.N {
+		l.failed = true
+		return 0, l.Err
+	}
+	return n, err
+}
@@ -0,0 +1,129 @@
+package smtpd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func tempBlobStore(t *testing.T) *FileBlobStore {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fs, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// Message with a text part and the given attachment parts.
+func attachmentMessage(parts ...string) string {
+	msg := "Subject: test\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n"
+	for _, p := range parts {
+		msg += "--b\r\n" + p + "\r\n"
+	}
+	return msg + "--b--\r\n"
+}
+
+func TestAttachmentExtractor(t *testing.T) {
+	store := tempBlobStore(t)
+	x := &AttachmentExtractor{Store: store}
+	msg := attachmentMessage(
+		"Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"=?UTF-8?B?w6l0w6kudHh0?=\"\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8gd29ybGQ=",
+		"Content-Type: text/plain\r\nContent-Disposition: attachment; filename*=UTF-8''%E2%82%AC%20rates.txt\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nrate=3D1",
+		"Content-Type: image/png; name=\"../../etc/logo.png\"\r\nContent-Disposition: inline\r\nContent-ID: <logo@example.com>\r\n\r\nPNG",
+	)
+
+	manifest, err := x.Extract(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(manifest.Text) != "Hello" {
+		t.Errorf("Text is %q", manifest.Text)
+	}
+
+	want := []struct {
+		filename, content string
+	}{
+		{"été.txt", "hello world"},
+		{"€ rates.txt", "rate=1"},
+		{"logo.png", "PNG"},
+	}
+	if len(manifest.Attachments) != len(want) {
+		t.Fatalf("Manifest has %d attachments, want %d", len(manifest.Attachments), len(want))
+	}
+	for i, w := range want {
+		a := manifest.Attachments[i]
+		f, err := store.Open(a.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if a.Filename != w.filename || string(b) != w.content || a.Size != int64(len(w.content)) {
+			t.Errorf("Attachment %d is %+v with %q, want %q with %q", i, a, b, w.filename, w.content)
+		}
+	}
+	if a := manifest.Attachments[2]; !a.Inline || a.ContentID != "logo@example.com" {
+		t.Errorf("Inline attachment %+v", a)
+	}
+}
+
+func TestAttachmentExtractorLimits(t *testing.T) {
+	attachment := "Content-Type: application/octet-stream\r\n\r\n" + strings.Repeat("x", 100)
+	nested := "Content-Type: text/plain\r\n\r\nHello"
+	for i := 0; i < 3; i++ {
+		nested = fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"n%d\"\r\n\r\n--n%d\r\n%s\r\n--n%d--", i, i, nested, i)
+	}
+
+	tests := []struct {
+		x   AttachmentExtractor
+		msg string
+		err *Error
+	}{
+		{AttachmentExtractor{MaxAttachmentSize: 50}, attachmentMessage(attachment), errAttachmentTooLarge},
+		{AttachmentExtractor{MaxTotalSize: 150}, attachmentMessage(attachment, attachment), errAttachmentsTooLarge},
+		{AttachmentExtractor{MaxParts: 3}, attachmentMessage(attachment, attachment), errTooManyParts},
+		{AttachmentExtractor{MaxDepth: 2}, attachmentMessage(nested), errMIMETooDeep},
+	}
+	for i, tt := range tests {
+		store := tempBlobStore(t)
+		tt.x.Store = store
+		_, err := tt.x.Extract(strings.NewReader(tt.msg))
+		if err != tt.err {
+			t.Errorf("%d: Extract returned %v, want %v", i, err, tt.err)
+		}
+
+		// Nothing is left behind.
+		if names, _ := ioutil.ReadDir(store.Dir); len(names) != 0 {
+			t.Errorf("%d: Store contains %d files after failure", i, len(names))
+		}
+	}
+}
+
+func TestAttachmentExtractorHandlerFailed(t *testing.T) {
+	store := tempBlobStore(t)
+	x := &AttachmentExtractor{Store: store}
+	handler := x.HandlerMessage(func(env *Envelope, manifest *Manifest) error {
+		return &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Try again later"}
+	})
+	msg := attachmentMessage("Content-Type: application/octet-stream\r\n\r\ndata")
+	if handler(&Envelope{}, strings.NewReader(msg)) == nil {
+		t.Fatal("HandlerMessage succeeded, want fn's error")
+	}
+
+	// Retries must not leave attachments of failed deliveries behind.
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Store has %d blobs after fn failed, want 0", len(files))
+	}
+}
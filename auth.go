@@ -0,0 +1,176 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+)
+
+// HandlerAuth function called to check credentials given with AUTH PLAIN or
+// AUTH LOGIN. Return an error for temporary failures, such as an unreachable
+// user database, which are reported with 454.
+type HandlerAuth func(remoteAddr net.Addr, mechanism string, username string, password string) (bool, error)
+
+// HandlerSender function called in authenticated sessions to check that the
+// identity may send as the MAIL FROM address and as every From: header address.
+type HandlerSender func(identity string, sender string) bool
+
+// HandlerAuthExternal function called for AUTH EXTERNAL (RFC 4422 appendix A)
+// with the verified client certificate and the authorization identity the
+// client asked for, which is empty if it didn't. Return the identity the
+// certificate maps to, or an empty string to reject it.
+type HandlerAuthExternal func(remoteAddr net.Addr, cert *x509.Certificate, authzid string) (string, error)
+
+// Mechanisms AUTH may use on the connection. PLAIN and LOGIN need TLS unless
+// AuthInsecure is set, EXTERNAL needs a verified client certificate.
+func (s *session) authMechanisms() []string {
+	var mechanisms []string
+	if s.srv.HandlerAuth != nil && (s.tls || s.srv.AuthInsecure) {
+		mechanisms = append(mechanisms, "PLAIN", "LOGIN")
+	}
+	if s.srv.HandlerAuthExternal != nil && s.peerCertificate() != nil {
+		mechanisms = append(mechanisms, "EXTERNAL")
+	}
+	return mechanisms
+}
+
+// Handle the AUTH command (RFC 4954).
+func (s *session) handleAuth(args string) {
+	mechanisms := s.authMechanisms()
+	if len(mechanisms) == 0 {
+		if s.srv.HandlerAuth != nil && !s.tls {
+			s.writef("538 5.7.11 Encryption required for requested authentication mechanism")
+		} else {
+			s.writef("502 5.5.1 Command not implemented")
+		}
+		return
+	}
+	if s.auth != "" {
+		s.writef("503 5.5.1 Bad sequence of commands (already authenticated)")
+		return
+	}
+	// AUTH is not permitted during a mail transaction.
+	if s.gotFrom {
+		s.writef("503 5.5.1 Bad sequence of commands (AUTH not permitted during mail transaction)")
+		return
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.writef("501 5.5.4 Syntax error in parameters or arguments")
+		return
+	}
+	mechanism := strings.ToUpper(fields[0])
+	initial := ""
+	if len(fields) == 2 {
+		initial = fields[1]
+	}
+	if indexFold(mechanisms, mechanism) == -1 {
+		s.writef("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+	if mechanism == "EXTERNAL" {
+		s.authExternal(initial)
+		return
+	}
+
+	var username, password string
+	var ok bool
+	switch mechanism {
+	case "PLAIN":
+		var resp []byte
+		resp, ok = s.authResponse(initial, "")
+		if !ok {
+			return
+		}
+		// authzid NUL authcid NUL passwd, acting as another user isn't supported.
+		parts := bytes.Split(resp, []byte{0})
+		if len(parts) != 3 || (len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1])) {
+			s.writef("501 5.5.2 Syntax error (invalid PLAIN response)")
+			return
+		}
+		username, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		var user, pass []byte
+		user, ok = s.authResponse(initial, "VXNlcm5hbWU6") // "Username:"
+		if !ok {
+			return
+		}
+		pass, ok = s.authResponse("", "UGFzc3dvcmQ6") // "Password:"
+		if !ok {
+			return
+		}
+		username, password = string(user), string(pass)
+	}
+
+	valid, err := s.srv.HandlerAuth(s.hookAddr(), mechanism, username, password)
+	if err != nil {
+		s.writef("454 4.7.0 Temporary authentication failure")
+		return
+	}
+	if !valid {
+		s.writef("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.auth = username
+	s.writef("235 2.7.0 Authentication successful")
+}
+
+// Authenticate with the client certificate, the response is the authorization identity.
+func (s *session) authExternal(initial string) {
+	authzid, ok := s.authResponse(initial, "")
+	if !ok {
+		return
+	}
+	identity, err := s.srv.HandlerAuthExternal(s.hookAddr(), s.peerCertificate(), string(authzid))
+	if err != nil {
+		s.writef("454 4.7.0 Temporary authentication failure")
+		return
+	}
+	if identity == "" {
+		s.writef("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.auth = identity
+	s.writef("235 2.7.0 Authentication successful")
+}
+
+// The verified client certificate, nil if the client didn't send one or it
+// wasn't verified.
+func (s *session) peerCertificate() *x509.Certificate {
+	state := s.info.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// Decode the initial response, or send a challenge and read the response.
+// Replies and returns false if the client cancelled or sent invalid base64.
+func (s *session) authResponse(initial string, challenge string) ([]byte, bool) {
+	line := initial
+	if line == "" {
+		s.writef("334 " + challenge)
+		var err error
+		line, err = s.readLine()
+		if err != nil {
+			return nil, false
+		}
+	}
+	if line == "*" {
+		s.writef("501 5.7.0 Authentication cancelled")
+		return nil, false
+	}
+	// "=" is an empty initial response.
+	if line == "=" {
+		return []byte{}, true
+	}
+	resp, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.writef("501 5.5.2 Syntax error (invalid base64)")
+		return nil, false
+	}
+	return resp, true
+}
@@ -0,0 +1,208 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var errNoCertificate = errors.New("smtpd: no certificate")
+
+// CertManager holds TLS certificates loaded from files and reloads them when
+// the files change, or when Reload is called, without a restart. Set
+// TLSConfig.GetCertificate to GetCertificate, or use TLSConfig. Sessions that
+// already completed the handshake keep the certificate they started with.
+type CertManager struct {
+	ReloadInterval time.Duration // How often the files are checked for changes, defaults to 10 seconds
+
+	mu        sync.Mutex
+	certs     []*managedCert
+	lastCheck time.Time
+}
+
+type managedCert struct {
+	certFile   string
+	keyFile    string
+	passphrase string
+
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// Add loads a certificate and key pair. The first certificate added is used
+// for clients that don't send SNI or ask for a name no certificate has.
+func (m *CertManager) Add(certFile string, keyFile string) error {
+	return m.AddWithPassphrase(certFile, keyFile, "")
+}
+
+// AddWithPassphrase loads a certificate and a key encrypted with passphrase.
+func (m *CertManager) AddWithPassphrase(certFile string, keyFile string, passphrase string) error {
+	mc := &managedCert{certFile: certFile, keyFile: keyFile, passphrase: passphrase}
+	err := mc.load()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certs = append(m.certs, mc)
+	m.lastCheck = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// Reload loads every certificate again. A certificate that fails to load or
+// validate keeps the previous one, and the first error is returned.
+func (m *CertManager) Reload() error {
+	m.mu.Lock()
+	certs := m.certs
+	m.lastCheck = time.Now()
+	m.mu.Unlock()
+
+	var firstErr error
+	for _, mc := range certs {
+		err := m.reload(mc)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// GetCertificate chooses the certificate for the name the client asked for
+// with SNI, reloading certificates whose files changed first.
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.reloadChanged()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.certs) == 0 {
+		return nil, errNoCertificate
+	}
+	if hello.ServerName != "" {
+		for _, mc := range m.certs {
+			if mc.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return mc.cert, nil
+			}
+		}
+	}
+	return m.certs[0].cert, nil
+}
+
+// TLSConfig returns a TLS configuration using the manager's certificates.
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.GetCertificate}
+}
+
+// Reload certificates whose files changed, checked at most once per ReloadInterval.
+func (m *CertManager) reloadChanged() {
+	interval := m.ReloadInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	m.mu.Lock()
+	if time.Since(m.lastCheck) < interval {
+		m.mu.Unlock()
+		return
+	}
+	m.lastCheck = time.Now()
+	certs := m.certs
+	m.mu.Unlock()
+
+	for _, mc := range certs {
+		certInfo, err := os.Stat(mc.certFile)
+		if err != nil {
+			continue
+		}
+		keyInfo, err := os.Stat(mc.keyFile)
+		if err != nil {
+			continue
+		}
+		m.mu.Lock()
+		changed := !certInfo.ModTime().Equal(mc.certMod) || !keyInfo.ModTime().Equal(mc.keyMod)
+		m.mu.Unlock()
+		if changed {
+			// Files being replaced may be half written, the old certificate stays until both are valid.
+			m.reload(mc)
+		}
+	}
+}
+
+// Load a certificate again into a copy, swapping it in only if it is valid.
+func (m *CertManager) reload(mc *managedCert) error {
+	m.mu.Lock()
+	next := &managedCert{certFile: mc.certFile, keyFile: mc.keyFile, passphrase: mc.passphrase}
+	m.mu.Unlock()
+
+	err := next.load()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	mc.cert, mc.certMod, mc.keyMod = next.cert, next.certMod, next.keyMod
+	m.mu.Unlock()
+	return nil
+}
+
+// Load and validate the files.
+func (mc *managedCert) load() error {
+	certInfo, err := os.Stat(mc.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(mc.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := loadKeyPair(mc.certFile, mc.keyFile, mc.passphrase)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("smtpd: certificate %s expired on %s", mc.certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	mc.cert = &cert
+	mc.certMod = certInfo.ModTime()
+	mc.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// Load a certificate and key pair, decrypting the key if passphrase isn't empty.
+func loadKeyPair(certFile string, keyFile string, passphrase string) (tls.Certificate, error) {
+	if passphrase == "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	if keyDERBlock == nil {
+		return tls.Certificate{}, errors.New("smtpd: no PEM data in " + keyFile)
+	}
+	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var pemBlock pem.Block
+	pemBlock.Type = keyDERBlock.Type
+	pemBlock.Bytes = keyPEMDecrypted
+	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+}
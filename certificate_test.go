@@ -0,0 +1,129 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate for name and its key into dir.
+func writeCert(t *testing.T, dir string, name string, serial int64, notAfter time.Time) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the change is seen even on filesystems with coarse timestamps.
+	mod := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+func serialFor(t *testing.T, m *CertManager, serverName string) int64 {
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := time.Now().Add(time.Hour)
+
+	m := &CertManager{ReloadInterval: time.Nanosecond}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("GetCertificate without certificates succeeded")
+	}
+	aCert, aKey := writeCert(t, dir, "a.example.com", 1, valid)
+	bCert, bKey := writeCert(t, dir, "b.example.com", 2, valid)
+	if err := m.Add(aCert, aKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(bCert, bKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Certificates are chosen by SNI, defaulting to the first.
+	for name, want := range map[string]int64{"a.example.com": 1, "b.example.com": 2, "c.example.com": 1, "": 1} {
+		if got := serialFor(t, m, name); got != want {
+			t.Errorf("Certificate for %q has serial %d, want %d", name, got, want)
+		}
+	}
+
+	// Changed files are picked up.
+	writeCert(t, dir, "a.example.com", 3, valid)
+	if got := serialFor(t, m, "a.example.com"); got != 3 {
+		t.Errorf("Reloaded certificate has serial %d, want 3", got)
+	}
+
+	// A broken file keeps the previous certificate.
+	ioutil.WriteFile(aKey, []byte("broken"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(aKey, later, later)
+	if got := serialFor(t, m, "a.example.com"); got != 3 {
+		t.Errorf("Certificate with broken key has serial %d, want 3", got)
+	}
+
+	// So does an expired one, and Reload reports why.
+	writeCert(t, dir, "b.example.com", 4, time.Now().Add(-time.Hour))
+	if err := m.Reload(); err == nil {
+		t.Error("Reload with broken and expired certificates succeeded")
+	}
+	if got := serialFor(t, m, "b.example.com"); got != 2 {
+		t.Errorf("Expired certificate has serial %d, want 2", got)
+	}
+
+	// The manager plugs into a TLS handshake.
+	srv := &Server{Hostname: "b.example.com", TLSConfig: m.TLSConfig()}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO client.example.com", 250)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "b.example.com", InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tlsConn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); got != 2 {
+		t.Errorf("Handshake used serial %d, want 2", got)
+	}
+	tlsConn.Close()
+}
@@ -0,0 +1,145 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Clamd scans messages for viruses with ClamAV's clamd daemon using the INSTREAM command.
+// The message it receives has already been read through MaxReader, so it never
+// exceeds the server's MaxSize.
+type Clamd struct {
+	Network   string        // "tcp" or "unix", defaults to "tcp"
+	Address   string        // Defaults to "127.0.0.1:3310"
+	Timeout   time.Duration // Timeout for the whole scan, defaults to 30 seconds
+	ChunkSize int           // Size of each INSTREAM chunk, defaults to 64 KiB
+	MaxSize   int64         // Only the first MaxSize bytes are scanned, should not exceed clamd's StreamMaxLength (default 25 MB). 0 scans everything.
+	Reply     *Error        // Reply for infected messages, defaults to 554 5.7.1
+}
+
+// Scan streams the message to clamd and reports any virus found.
+func (cd *Clamd) Scan(env *Envelope, msg io.Reader, size int64) (*ScanResult, error) {
+	timeout := cd.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	chunkSize := cd.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+	if cd.MaxSize > 0 {
+		msg = io.LimitReader(msg, cd.MaxSize)
+	}
+
+	conn, err := cd.dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The "z" prefix means commands and replies are null terminated.
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	chunk := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(msg, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			_, err = w.Write(chunk[:4+n])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	// A zero length chunk ends the stream.
+	w.Write([]byte{0, 0, 0, 0})
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return nil, err
+	}
+	return cd.parse(strings.TrimRight(reply, "\x00\n"))
+}
+
+// Parse a reply such as "stream: OK" or "stream: Eicar-Signature FOUND".
+func (cd *Clamd) parse(reply string) (*ScanResult, error) {
+	header := textproto.MIMEHeader{}
+	header.Set("X-Virus-Scanned", "ClamAV")
+
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return &ScanResult{Header: header}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		name := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		res := &ScanResult{Symbols: []string{name}, Header: header, Reply: cd.Reply}
+		if res.Reply == nil {
+			res.Reply = &Error{Code: 554, EnhancedCode: "5.7.1", Message: fmt.Sprintf("Message contains a virus (%s)", name)}
+		}
+		return res, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, errors.New("clamd: " + strings.TrimSuffix(reply, " ERROR"))
+	}
+	return nil, fmt.Errorf("clamd: invalid reply %q", reply)
+}
+
+// Ping checks that clamd is reachable and responding.
+func (cd *Clamd) Ping() error {
+	conn, err := cd.dial(5 * time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("zPING\x00"))
+	if err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Equal(bytes.TrimRight(reply, "\x00\n"), []byte("PONG")) {
+		return fmt.Errorf("clamd: invalid reply %q", reply)
+	}
+	return nil
+}
+
+// Connect to clamd with a deadline for the whole exchange.
+func (cd *Clamd) dial(timeout time.Duration) (net.Conn, error) {
+	network, address := cd.Network, cd.Address
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = "127.0.0.1:3310"
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,103 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Start a stub clamd that reports a virus if the stream contains "EICAR".
+// The received stream is sent on the returned channel.
+func startClamd(t *testing.T) (addr string, received chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = make(chan string, 1)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		cmd, _ := r.ReadString(0)
+		if cmd != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+
+		var stream []byte
+		for {
+			var size uint32
+			if binary.Read(r, binary.BigEndian, &size) != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size)
+			io.ReadFull(r, chunk)
+			stream = append(stream, chunk...)
+		}
+		received <- string(stream)
+
+		if strings.Contains(string(stream), "EICAR") {
+			conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestClamd(t *testing.T) {
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("clean ", 10)
+
+	// Clean messages are accepted, sent in chunks.
+	addr, received := startClamd(t)
+	cd := &Clamd{Address: addr, ChunkSize: 7}
+	res, err := cd.Scan(&Envelope{}, strings.NewReader(msg), int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reply != nil || res.Header.Get("X-Virus-Scanned") == "" {
+		t.Errorf("Scan returned %+v, want clean result", res)
+	}
+	if got := <-received; got != msg {
+		t.Errorf("clamd received %q, want %q", got, msg)
+	}
+
+	// Infected messages are rejected.
+	addr, received = startClamd(t)
+	cd = &Clamd{Address: addr}
+	res, err = cd.Scan(&Envelope{}, strings.NewReader(msg+"EICAR"), int64(len(msg)+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if res.Reply == nil || res.Reply.Code != 554 || res.Symbols[0] != "Eicar-Signature" {
+		t.Errorf("Scan returned %+v, want 554 with virus name", res)
+	}
+
+	// Nothing past MaxSize is sent.
+	addr, received = startClamd(t)
+	cd = &Clamd{Address: addr, MaxSize: int64(len(msg))}
+	res, err = cd.Scan(&Envelope{}, strings.NewReader(msg+"EICAR"), int64(len(msg)+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != msg {
+		t.Errorf("clamd received %q, want %q", got, msg)
+	}
+	if res.Reply != nil {
+		t.Errorf("Scan returned %+v, want clean result", res)
+	}
+}
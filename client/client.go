@@ -0,0 +1,688 @@
+// Package client implements an SMTP client for relaying mail to other servers.
+// It resolves MX records, tries hosts in preference order, negotiates STARTTLS,
+// pipelines commands when the server supports it and reports the outcome for
+// every recipient.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLSPolicy decides how STARTTLS is used.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS when the server offers it, without verifying
+	// the certificate, and falls back to plain text if the handshake fails.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSMandatory requires STARTTLS with a verified certificate.
+	TLSMandatory
+	// TLSDisabled never uses STARTTLS.
+	TLSDisabled
+)
+
+// Status is the outcome of a delivery attempt for a recipient.
+type Status int
+
+const (
+	StatusDelivered Status = iota // Accepted by the server
+	StatusTempFail                // Failed temporarily, try again later
+	StatusPermFail                // Failed permanently, don't try again
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusDelivered:
+		return "delivered"
+	case StatusTempFail:
+		return "temporary failure"
+	}
+	return "permanent failure"
+}
+
+// Resolver looks up MX records. *net.Resolver implements it.
+// A Resolver reports a domain without MX records with an empty result and a
+// domain that doesn't exist with a *net.DNSError with IsNotFound set. Resolvers
+// that report both as not found, like *net.Resolver, must also implement
+// LookupHost(ctx, host) ([]string, error) so the implicit MX can be found.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Error is an SMTP reply from the remote server.
+type Error struct {
+	Code         int    // Reply code, e.g. 550
+	EnhancedCode string // RFC 3463 enhanced status code, e.g. "5.1.1"
+	Message      string
+}
+
+func (err *Error) Error() string {
+	if err.EnhancedCode == "" {
+		return fmt.Sprintf("%d %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%d %s %s", err.Code, err.EnhancedCode, err.Message)
+}
+
+// Temporary reports if the reply is a 4xx reply.
+func (err *Error) Temporary() bool {
+	return err.Code >= 400 && err.Code < 500
+}
+
+// Message is a message to be relayed.
+type Message struct {
+	From string
+	To   []string
+	Body io.ReadSeeker // Complete message, read again for every host tried
+
+	// DSN parameters (RFC 3461), only sent to servers supporting DSN.
+	Ret    string            // "FULL" or "HDRS"
+	EnvID  string            // Envelope identifier
+	Notify map[string]string // NOTIFY of each recipient, e.g. "FAILURE,DELAY" or "NEVER"
+	ORCPT  map[string]string // Original recipient of each recipient
+
+	// RequireTLS (RFC 8689) only delivers over STARTTLS with a verified
+	// certificate to servers that support REQUIRETLS, whatever the TLSPolicy.
+	RequireTLS bool
+}
+
+// RecipientResult is the outcome for a single recipient.
+type RecipientResult struct {
+	Address string
+	Status  Status
+	Err     error // *Error for server replies, otherwise a network, DNS or TLS error
+}
+
+// Result is the outcome of delivering a message to one destination.
+type Result struct {
+	Host       string // Host that handled the transaction, empty if none could be reached
+	TLS        bool   // The transaction used TLS
+	Recipients []RecipientResult
+}
+
+// Client relays messages to SMTP servers.
+type Client struct {
+	Hostname  string                                          // Name sent with EHLO, defaults to os.Hostname()
+	Resolver  Resolver                                        // Defaults to net.DefaultResolver
+	Dial      func(network, address string) (net.Conn, error) // Defaults to a net.Dialer using Timeout
+	Port      string                                          // Port used for MX hosts, defaults to "25"
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config   // Base configuration for STARTTLS, ServerName is set for every host
+	Auth      smtp.Auth     // Authenticate with AUTH after STARTTLS, optional
+	Timeout   time.Duration // Timeout for connecting and each command, defaults to 5 minutes
+}
+
+var (
+	errNullMX   = &Error{Code: 556, EnhancedCode: "5.1.10", Message: "Domain does not accept mail (null MX)"}
+	errNoDomain = &Error{Code: 550, EnhancedCode: "5.1.2", Message: "Domain not found"}
+	errNoTLS    = errors.New("client: STARTTLS required but not offered")
+	errNoAuth   = errors.New("client: AUTH required but not offered")
+	errTooLarge = &Error{Code: 552, EnhancedCode: "5.3.4", Message: "Message size exceeds fixed maximum message size"}
+
+	errRequireTLS = &Error{Code: 550, EnhancedCode: "5.7.10", Message: "REQUIRETLS not supported by server"}
+
+	enhancedCodeRE = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+)
+
+// Send delivers the message to the MX hosts of every recipient domain and
+// returns the outcome for each recipient, in the order of msg.To.
+func (c *Client) Send(msg *Message) []RecipientResult {
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, to := range msg.To {
+		domain := strings.ToLower(to[strings.LastIndex(to, "@")+1:])
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], to)
+	}
+
+	results := make(map[string]RecipientResult)
+	for _, domain := range domains {
+		m := *msg
+		m.To = byDomain[domain]
+		for _, r := range c.SendDomain(domain, &m).Recipients {
+			results[r.Address] = r
+		}
+	}
+
+	out := make([]RecipientResult, len(msg.To))
+	for i, to := range msg.To {
+		out[i] = results[to]
+	}
+	return out
+}
+
+// SendDomain delivers the message to the MX hosts of domain, in preference order.
+// Domains without MX records are delivered to directly (RFC 5321 section 5.1).
+func (c *Client) SendDomain(domain string, msg *Message) *Result {
+	hosts, err := c.lookupMX(domain)
+	if err != nil {
+		return failAll(msg.To, err)
+	}
+	return c.SendHosts(hosts, msg)
+}
+
+// SendHosts delivers the message to the first of hosts that accepts the
+// transaction. Hosts are given as "host" or "host:port".
+func (c *Client) SendHosts(hosts []string, msg *Message) *Result {
+	res := failAll(msg.To, errors.New("client: no hosts to try"))
+	for _, host := range hosts {
+		var retry bool
+		res, retry = c.transaction(host, msg, c.TLSPolicy)
+		if !retry {
+			break
+		}
+	}
+	return res
+}
+
+// Look up the MX hosts of domain in preference order.
+func (c *Client) lookupMX(domain string) ([]string, error) {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return implicitMX(ctx, resolver, domain)
+		}
+		if len(mxs) == 0 {
+			return nil, err
+		}
+	}
+	// The domain exists but has no MX records, its address is the implicit MX.
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	// RFC 7505 null MX.
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errNullMX
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// Tell a domain without MX records, whose address is the implicit MX (RFC 5321
+// section 5.1), from one that doesn't exist and fails permanently.
+func implicitMX(ctx context.Context, resolver Resolver, domain string) ([]string, error) {
+	hr, ok := resolver.(hostResolver)
+	if !ok {
+		return nil, errNoDomain
+	}
+	_, err := hr.LookupHost(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errNoDomain
+		}
+		return nil, err
+	}
+	return []string{domain}, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// Run a single SMTP transaction with host. retry reports if the next host
+// should be tried because this one couldn't handle the transaction.
+func (c *Client) transaction(host string, msg *Message, policy TLSPolicy) (res *Result, retry bool) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := c.Port
+		if port == "" {
+			port = "25"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	serverName, _, _ := net.SplitHostPort(addr)
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		return failAll(msg.To, err), true
+	}
+	cn := &smtpConn{conn: conn, text: textproto.NewConn(conn), timeout: c.timeout()}
+	defer cn.close()
+
+	fail := func(err error) (*Result, bool) {
+		res := failAll(msg.To, err)
+		res.Host = host
+		res.TLS = cn.tls
+		return res, true
+	}
+
+	// Servers may refuse the connection with 554 instead of the banner.
+	_, err = cn.read()
+	if err != nil {
+		return fail(err)
+	}
+	ext, err := cn.hello(c.hostname())
+	if err != nil {
+		return fail(err)
+	}
+
+	if msg.RequireTLS {
+		policy = TLSMandatory
+	}
+	if policy != TLSDisabled {
+		_, offered := ext["STARTTLS"]
+		if !offered && msg.RequireTLS {
+			return fail(errRequireTLS)
+		}
+		if !offered && policy == TLSMandatory {
+			return fail(errNoTLS)
+		}
+		if offered {
+			err = cn.startTLS(c.tlsConfig(serverName, policy))
+			if err != nil && policy == TLSOpportunistic {
+				// Retry in plain text rather than not delivering at all.
+				cn.close()
+				return c.transaction(host, msg, TLSDisabled)
+			}
+			if err != nil {
+				return fail(err)
+			}
+			ext, err = cn.hello(c.hostname())
+			if err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	if _, ok := ext["REQUIRETLS"]; msg.RequireTLS && !ok {
+		return fail(errRequireTLS)
+	}
+
+	if c.Auth != nil {
+		err = cn.auth(c.Auth, serverName, ext)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	res, err = cn.send(ext, msg)
+	if err != nil {
+		return fail(err)
+	}
+	res.Host = host
+	res.TLS = cn.tls
+	cn.cmd("QUIT")
+	return res, false
+}
+
+func (c *Client) dial(addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial("tcp", addr)
+	}
+	d := &net.Dialer{Timeout: c.timeout()}
+	return d.Dial("tcp", addr)
+}
+
+func (c *Client) hostname() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 5 * time.Minute
+	}
+	return c.Timeout
+}
+
+func (c *Client) tlsConfig(serverName string, policy TLSPolicy) *tls.Config {
+	var config *tls.Config
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	config.ServerName = serverName
+
+	// Most MX hosts have certificates that don't verify, opportunistic TLS
+	// still protects against passive eavesdropping.
+	if policy == TLSOpportunistic && c.TLSConfig == nil {
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+// smtpConn is a connection to an SMTP server.
+type smtpConn struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+	tls     bool
+	code    int // Code of the last reply
+}
+
+func (cn *smtpConn) close() {
+	cn.conn.Close()
+}
+
+// Send a command and read the reply.
+func (cn *smtpConn) cmd(format string, args ...interface{}) (string, error) {
+	err := cn.write(format, args...)
+	if err != nil {
+		return "", err
+	}
+	return cn.read()
+}
+
+func (cn *smtpConn) write(format string, args ...interface{}) error {
+	cn.conn.SetWriteDeadline(time.Now().Add(cn.timeout))
+	return cn.text.PrintfLine(format, args...)
+}
+
+// Read a reply, returning an *Error for anything but 2xx and 3xx replies.
+func (cn *smtpConn) read() (string, error) {
+	cn.conn.SetReadDeadline(time.Now().Add(cn.timeout))
+	code, msg, err := cn.text.ReadResponse(0)
+	cn.code = code
+	if err != nil && code == 0 {
+		return "", err
+	}
+	if code >= 400 {
+		return msg, replyError(code, msg)
+	}
+	return msg, nil
+}
+
+// Send EHLO, falling back to HELO, and return the supported extensions.
+func (cn *smtpConn) hello(name string) (map[string]string, error) {
+	msg, err := cn.cmd("EHLO %s", name)
+	if err != nil {
+		if e, ok := err.(*Error); !ok || e.Code < 500 {
+			return nil, err
+		}
+		_, err = cn.cmd("HELO %s", name)
+		return map[string]string{}, err
+	}
+
+	ext := make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		keyword, param := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			keyword, param = line[:i], line[i+1:]
+		}
+		ext[strings.ToUpper(keyword)] = param
+	}
+	return ext, nil
+}
+
+func (cn *smtpConn) startTLS(config *tls.Config) error {
+	_, err := cn.cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Client(cn.conn, config)
+	tlsConn.SetDeadline(time.Now().Add(cn.timeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	cn.conn = tlsConn
+	cn.text = textproto.NewConn(tlsConn)
+	cn.tls = true
+	return nil
+}
+
+// Authenticate with the AUTH command (RFC 4954).
+func (cn *smtpConn) auth(a smtp.Auth, serverName string, ext map[string]string) error {
+	mechanisms, ok := ext["AUTH"]
+	if !ok {
+		return errNoAuth
+	}
+	info := &smtp.ServerInfo{Name: serverName, TLS: cn.tls, Auth: strings.Fields(mechanisms)}
+	mech, resp, err := a.Start(info)
+	if err != nil {
+		return err
+	}
+
+	cmd := "AUTH " + mech
+	if resp != nil {
+		cmd += " " + base64.StdEncoding.EncodeToString(resp)
+	}
+	msg, err := cn.cmd("%s", cmd)
+	for err == nil && cn.code == 334 {
+		var challenge []byte
+		challenge, err = base64.StdEncoding.DecodeString(msg)
+		if err == nil {
+			resp, err = a.Next(challenge, true)
+		}
+		if err != nil {
+			// Cancel the exchange.
+			cn.cmd("*")
+			return err
+		}
+		msg, err = cn.cmd("%s", base64.StdEncoding.EncodeToString(resp))
+	}
+	return err
+}
+
+// Run the mail transaction, pipelining MAIL, RCPT and DATA if the server supports it.
+func (cn *smtpConn) send(ext map[string]string, msg *Message) (*Result, error) {
+	size, err := msg.Body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = msg.Body.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't send what the server already said it won't accept.
+	if max, ok := ext["SIZE"]; ok {
+		if n, err := strconv.ParseInt(max, 10, 64); err == nil && n > 0 && size > n {
+			res := failAll(msg.To, errTooLarge)
+			return res, nil
+		}
+	}
+
+	mail := fmt.Sprintf("MAIL FROM:<%s>", msg.From)
+	if _, ok := ext["SIZE"]; ok {
+		mail += fmt.Sprintf(" SIZE=%d", size)
+	}
+	_, dsn := ext["DSN"]
+	if dsn && msg.Ret != "" {
+		mail += " RET=" + msg.Ret
+	}
+	if dsn && msg.EnvID != "" {
+		mail += " ENVID=" + xtext(msg.EnvID)
+	}
+	if msg.RequireTLS {
+		mail += " REQUIRETLS"
+	}
+
+	rcpts := make([]string, len(msg.To))
+	for i, to := range msg.To {
+		rcpts[i] = fmt.Sprintf("RCPT TO:<%s>", to)
+		if notify := msg.Notify[to]; dsn && notify != "" {
+			rcpts[i] += " NOTIFY=" + notify
+		}
+		if orcpt := msg.ORCPT[to]; dsn && orcpt != "" {
+			rcpts[i] += " ORCPT=rfc822;" + xtext(orcpt)
+		}
+	}
+
+	_, pipelining := ext["PIPELINING"]
+	res := &Result{Recipients: make([]RecipientResult, len(msg.To))}
+
+	// Without pipelining every command waits for its reply.
+	if pipelining {
+		err = cn.write("%s", mail)
+		for i := 0; err == nil && i < len(rcpts); i++ {
+			err = cn.write("%s", rcpts[i])
+		}
+		if err == nil {
+			err = cn.write("DATA")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	command := func(line string) error {
+		if pipelining {
+			_, err := cn.read()
+			return err
+		}
+		_, err := cn.cmd("%s", line)
+		return err
+	}
+
+	mailErr := command(mail)
+	if mailErr != nil {
+		if _, ok := mailErr.(*Error); !ok {
+			return nil, mailErr
+		}
+	}
+
+	accepted := 0
+	for i, to := range msg.To {
+		res.Recipients[i].Address = to
+		rcptErr := mailErr
+		// Pipelined replies have to be read, otherwise nothing follows a failed MAIL.
+		if pipelining || mailErr == nil {
+			err := command(rcpts[i])
+			if _, ok := err.(*Error); err != nil && !ok {
+				return nil, err
+			}
+			if mailErr == nil {
+				rcptErr = err
+			}
+		}
+		if rcptErr != nil {
+			res.Recipients[i].Status = status(rcptErr)
+			res.Recipients[i].Err = rcptErr
+			continue
+		}
+		accepted++
+	}
+
+	// DATA was pipelined, its reply has to be read even when nobody was accepted.
+	var dataErr error
+	if pipelining || accepted > 0 {
+		dataErr = command("DATA")
+	}
+	if accepted == 0 {
+		if mailErr != nil && mailErr.(*Error).Temporary() {
+			// Another host might accept the sender.
+			return nil, mailErr
+		}
+		if pipelining && dataErr == nil {
+			// Pipelined DATA was accepted anyway, send an empty message end.
+			w := cn.text.DotWriter()
+			w.Close()
+			cn.read()
+		}
+		cn.cmd("RSET")
+		return res, nil
+	}
+	if dataErr == nil {
+		cn.conn.SetWriteDeadline(time.Now().Add(cn.timeout))
+		w := cn.text.DotWriter()
+		_, err = io.Copy(w, msg.Body)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, dataErr = cn.read()
+	}
+	if dataErr != nil {
+		if _, ok := dataErr.(*Error); !ok {
+			return nil, dataErr
+		}
+	}
+
+	for i := range res.Recipients {
+		r := &res.Recipients[i]
+		if r.Err != nil {
+			continue
+		}
+		if dataErr != nil {
+			r.Status = status(dataErr)
+			r.Err = dataErr
+		} else {
+			r.Status = StatusDelivered
+		}
+	}
+	return res, nil
+}
+
+// Every recipient failed with err.
+func failAll(to []string, err error) *Result {
+	res := &Result{Recipients: make([]RecipientResult, len(to))}
+	for i, addr := range to {
+		res.Recipients[i] = RecipientResult{Address: addr, Status: status(err), Err: err}
+	}
+	return res
+}
+
+// Classify an error: 5xx replies are permanent, everything else is temporary.
+func status(err error) Status {
+	if e, ok := err.(*Error); ok && !e.Temporary() {
+		return StatusPermFail
+	}
+	return StatusTempFail
+}
+
+func replyError(code int, msg string) *Error {
+	err := &Error{Code: code, Message: msg}
+	if parts := strings.SplitN(msg, " ", 2); len(parts) == 2 && enhancedCodeRE.MatchString(parts[0]) {
+		err.EnhancedCode = parts[0]
+		err.Message = parts[1]
+	}
+	return err
+}
+
+// Encode a DSN parameter as xtext (RFC 3461 section 4).
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,298 @@
+package client_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xeoncross/smtpd"
+	"github.com/Xeoncross/smtpd/client"
+)
+
+type resolver map[string][]*net.MX
+
+func (r resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+type received struct {
+	from string
+	to   []string
+	body string
+}
+
+// Start a server on a random port, returning its address.
+func startServer(t *testing.T, srv *smtpd.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+// Self-signed certificate for STARTTLS.
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Client that connects to addrs instead of the real address of each host.
+func testClient(addrs map[string]string, mxs resolver) *client.Client {
+	return &client.Client{
+		Hostname: "relay.example.com",
+		Resolver: mxs,
+		Timeout:  2 * time.Second,
+		Dial: func(network, address string) (net.Conn, error) {
+			addr, ok := addrs[address]
+			if !ok {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: io.EOF}
+			}
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+func TestSendDomain(t *testing.T) {
+	messages := make(chan received, 1)
+	addr := startServer(t, &smtpd.Server{
+		Hostname:  "mx.example.com",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCert(t)}},
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			return to != "unknown@example.com"
+		},
+		Handler: func(bytesRead int, remoteAddr net.Addr, from string, to []string, header textproto.MIMEHeader, body io.Reader) error {
+			b, _ := ioutil.ReadAll(body)
+			messages <- received{from, to, string(b)}
+			return nil
+		},
+	})
+
+	// The first MX is down, the second one takes the message.
+	c := testClient(map[string]string{"mx.example.com:25": addr}, resolver{
+		"example.com": {{Host: "mx.example.com.", Pref: 20}, {Host: "down.example.com.", Pref: 10}},
+	})
+	res := c.SendDomain("example.com", &client.Message{
+		From: "sender@example.org",
+		To:   []string{"recipient@example.com", "unknown@example.com"},
+		Body: strings.NewReader("Subject: test\r\n\r\nTest message.\r\n"),
+	})
+
+	if res.Host != "mx.example.com" || !res.TLS {
+		t.Errorf("Delivered to %q with TLS %v, want mx.example.com with TLS", res.Host, res.TLS)
+	}
+	if r := res.Recipients[0]; r.Status != client.StatusDelivered || r.Err != nil {
+		t.Errorf("First recipient %+v, want delivered", r)
+	}
+	r := res.Recipients[1]
+	if e, ok := r.Err.(*client.Error); r.Status != client.StatusPermFail || !ok || e.Code != 550 || e.EnhancedCode != "5.1.0" {
+		t.Errorf("Second recipient %+v, want 550 5.1.0", r)
+	}
+
+	select {
+	case m := <-messages:
+		if m.from != "sender@example.org" || len(m.to) != 1 || m.to[0] != "recipient@example.com" || strings.TrimSpace(m.body) != "Test message." {
+			t.Errorf("Server received %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server did not receive the message")
+	}
+}
+
+func TestSendFailures(t *testing.T) {
+	addr := startServer(t, &smtpd.Server{Hostname: "mx.example.com", MaxSize: 10})
+	c := testClient(map[string]string{"mx.example.com:25": addr}, resolver{
+		"example.com":      {{Host: "mx.example.com.", Pref: 10}},
+		"null.example.com": {{Host: ".", Pref: 0}},
+		"nomx.example.com": {},
+	})
+
+	tests := []struct {
+		to     string
+		policy client.TLSPolicy
+		body   string
+		status client.Status
+		code   int
+	}{
+		// Too large for the advertised SIZE, nothing is sent.
+		{"recipient@example.com", client.TLSOpportunistic, strings.Repeat("x", 20), client.StatusPermFail, 552},
+		// STARTTLS is not offered.
+		{"recipient@example.com", client.TLSMandatory, "x", client.StatusTempFail, 0},
+		// Null MX.
+		{"recipient@null.example.com", client.TLSOpportunistic, "x", client.StatusPermFail, 556},
+		// The domain doesn't exist.
+		{"recipient@example.net", client.TLSOpportunistic, "x", client.StatusPermFail, 550},
+		// No MX and no server for the implicit MX.
+		{"recipient@nomx.example.com", client.TLSOpportunistic, "x", client.StatusTempFail, 0},
+	}
+
+	for _, tt := range tests {
+		c.TLSPolicy = tt.policy
+		results := c.Send(&client.Message{From: "sender@example.org", To: []string{tt.to}, Body: strings.NewReader(tt.body)})
+		r := results[0]
+		if r.Status != tt.status {
+			t.Errorf("%s: status %v (%v), want %v", tt.to, r.Status, r.Err, tt.status)
+		}
+		if e, ok := r.Err.(*client.Error); tt.code != 0 && (!ok || e.Code != tt.code) {
+			t.Errorf("%s: error %v, want %d", tt.to, r.Err, tt.code)
+		}
+	}
+}
+
+// Resolver that reports domains without MX records as not found, like the
+// standard library does.
+type hostResolver struct {
+	resolver
+	hosts map[string]bool
+}
+
+func (r hostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if !r.hosts[host] {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+func TestSendImplicitMX(t *testing.T) {
+	addr := startServer(t, &smtpd.Server{Hostname: "example.com"})
+	c := testClient(map[string]string{"example.com:25": addr}, nil)
+	c.Resolver = hostResolver{resolver{}, map[string]bool{"example.com": true}}
+
+	// A domain without MX records gets mail at its address.
+	res := c.SendDomain("example.com", &client.Message{From: "sender@example.org", To: []string{"a@example.com"}, Body: strings.NewReader("Subject: test\r\n\r\nTest\r\n")})
+	if r := res.Recipients[0]; r.Status != client.StatusDelivered {
+		t.Errorf("Delivery to the implicit MX: %v %v", r.Status, r.Err)
+	}
+
+	// A domain that doesn't exist fails permanently.
+	res = c.SendDomain("example.net", &client.Message{From: "sender@example.org", To: []string{"a@example.net"}, Body: strings.NewReader("x")})
+	r := res.Recipients[0]
+	if e, ok := r.Err.(*client.Error); r.Status != client.StatusPermFail || !ok || e.EnhancedCode != "5.1.2" {
+		t.Errorf("Delivery to a missing domain: %v %v, want 5.1.2", r.Status, r.Err)
+	}
+}
+
+func TestSendRequireTLS(t *testing.T) {
+	cert := testCert(t)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	var got *smtpd.Envelope
+	tlsAddr := startServer(t, &smtpd.Server{
+		Hostname:  "mx.example.com",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandlerMessage: func(env *smtpd.Envelope, msg io.Reader) error {
+			got = env
+			return nil
+		},
+	})
+	plainAddr := startServer(t, &smtpd.Server{Hostname: "mx.example.net"})
+	c := testClient(map[string]string{"mx.example.com:25": tlsAddr, "mx.example.net:25": plainAddr}, resolver{
+		"example.com": {{Host: "mx.example.com.", Pref: 10}},
+		"example.net": {{Host: "mx.example.net.", Pref: 10}},
+	})
+	c.TLSPolicy = client.TLSDisabled
+	c.TLSConfig = &tls.Config{RootCAs: roots}
+
+	msg := &client.Message{From: "sender@example.org", To: []string{"a@example.com", "b@example.net"}, Body: strings.NewReader("Subject: test\r\n\r\nTest\r\n"), RequireTLS: true}
+	results := c.Send(msg)
+	if results[0].Status != client.StatusDelivered || got == nil || !got.RequireTLS {
+		t.Errorf("Delivery over TLS: %v %v, envelope %+v", results[0].Status, results[0].Err, got)
+	}
+	if e, ok := results[1].Err.(*client.Error); results[1].Status != client.StatusPermFail || !ok || e.EnhancedCode != "5.7.10" {
+		t.Errorf("Delivery without TLS: %v %v, want 5.7.10", results[1].Status, results[1].Err)
+	}
+}
+
+func TestSendMailRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Server without PIPELINING that rejects every sender.
+	commands := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 mx.example.com ESMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				close(commands)
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			commands <- verb
+			switch verb {
+			case "EHLO":
+				tc.PrintfLine("250 mx.example.com")
+			case "MAIL":
+				tc.PrintfLine("550 5.7.1 Sender rejected")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+			default:
+				tc.PrintfLine("250 Ok")
+			}
+		}
+	}()
+
+	c := testClient(map[string]string{"mx.example.com:25": ln.Addr().String()}, resolver{
+		"example.com": {{Host: "mx.example.com.", Pref: 10}},
+	})
+	res := c.SendDomain("example.com", &client.Message{
+		From: "sender@example.org",
+		To:   []string{"a@example.com", "b@example.com"},
+		Body: strings.NewReader("Subject: test\r\n\r\nTest message.\r\n"),
+	})
+	for _, r := range res.Recipients {
+		if e, ok := r.Err.(*client.Error); r.Status != client.StatusPermFail || !ok || e.Code != 550 {
+			t.Errorf("Recipient %+v, want 550", r)
+		}
+	}
+
+	for verb := range commands {
+		switch verb {
+		case "EHLO", "MAIL", "RSET", "QUIT":
+		default:
+			t.Errorf("Client sent %q after MAIL was rejected", verb)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Session is the view of an SMTP session given to Command handlers.
+type Session interface {
+	RemoteAddr() net.Addr                             // Address of the client
+	ConnInfo() *ConnInfo                              // Listener and TLS state of the connection
+	Helo() string                                     // Hostname supplied with HELO/EHLO
+	Auth() string                                     // Identity the client authenticated as, empty if it didn't
+	TLS() *tls.ConnectionState                        // nil without TLS
+	Transaction() (from string, to []string, ok bool) // Current mail transaction, ok is false outside one
+
+	// Reply writes a reply. Multiline replies are written with \n between lines.
+	Reply(code int, enhancedCode string, format string, args ...interface{}) error
+	// ReadLine reads a line from the client, for commands with several steps.
+	ReadLine() (string, error)
+	// Reset aborts the current mail transaction.
+	Reset()
+}
+
+// Command is an additional verb, such as XCLIENT or a vendor extension.
+type Command struct {
+	Handler   func(s Session, args string) // Must write a reply
+	Keyword   string                       // EHLO keyword with any parameters, e.g. "XSTATS", nothing is advertised if empty
+	BeforeTLS bool                         // Allowed before STARTTLS when TLS is required
+}
+
+// RemoteAddr implements Session.
+func (s *session) RemoteAddr() net.Addr {
+	return s.info.RemoteAddr
+}
+
+// ConnInfo implements Session.
+func (s *session) ConnInfo() *ConnInfo {
+	return s.info
+}
+
+// Helo implements Session.
+func (s *session) Helo() string {
+	return s.remoteName
+}
+
+// Auth implements Session.
+func (s *session) Auth() string {
+	return s.auth
+}
+
+// TLS implements Session.
+func (s *session) TLS() *tls.ConnectionState {
+	return s.info.TLS
+}
+
+// Transaction implements Session.
+func (s *session) Transaction() (string, []string, bool) {
+	return s.from, s.to, s.gotFrom
+}
+
+// Reply implements Session.
+func (s *session) Reply(code int, enhancedCode string, format string, args ...interface{}) error {
+	lines := strings.Split(fmt.Sprintf(format, args...), "\n")
+	var b strings.Builder
+	for i, line := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "%d%s", code, sep)
+		if enhancedCode != "" {
+			b.WriteString(enhancedCode + " ")
+		}
+		b.WriteString(line)
+	}
+	return s.writef("%s", b.String())
+}
+
+// ReadLine implements Session.
+func (s *session) ReadLine() (string, error) {
+	return s.readLine()
+}
+
+// Reset implements Session.
+func (s *session) Reset() {
+	s.reset()
+}
+
+// Run a registered command, or reply that verb is unknown.
+func (s *session) handleCommand(verb string, args string) {
+	cmd, ok := s.srv.Commands[verb]
+	if !ok || cmd.Handler == nil {
+		// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+		s.writef("500 5.5.2 Syntax error, command unrecognized")
+		return
+	}
+	if !cmd.BeforeTLS && s.tlsRequired() && !s.tls {
+		s.writef("530 5.7.0 Must issue a STARTTLS command first")
+		return
+	}
+	cmd.Handler(s, args)
+}
+
+// EHLO keywords of the registered commands that can be used now, sorted.
+func (s *session) commandKeywords() []string {
+	var keywords []string
+	for verb, cmd := range s.srv.Commands {
+		if cmd.Keyword == "" || (!cmd.BeforeTLS && s.tlsRequired() && !s.tls) {
+			continue
+		}
+		// The built-in ETRN takes precedence and is advertised on its own.
+		if verb == "ETRN" && s.srv.HandlerETRN != nil {
+			continue
+		}
+		keywords = append(keywords, cmd.Keyword)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
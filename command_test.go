@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	var helo string
+	srv := &Server{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSRequired: true,
+		Commands: map[string]*Command{
+			"XSTATS": {
+				Keyword: "XSTATS",
+				Handler: func(s Session, args string) {
+					helo = s.Helo()
+					s.Reply(250, "2.0.0", "messages 3\nbytes %s", "1024")
+				},
+			},
+			"XECHO": {
+				BeforeTLS: true,
+				Handler: func(s Session, args string) {
+					s.Reply(354, "", "Send a line")
+					line, err := s.ReadLine()
+					if err != nil {
+						return
+					}
+					s.Reply(250, "2.0.0", "%s %s", args, line)
+				},
+			},
+			"NOOP": {
+				Handler: func(s Session, args string) {
+					s.Reply(550, "", "Overridden")
+				},
+			},
+		},
+	}
+	conn := newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO client.example.com", 250); strings.Contains(msg, "XSTATS") {
+		t.Errorf("XSTATS advertised before STARTTLS: %q", msg)
+	}
+	cmdCode(t, conn, "XSTATS", 530)
+	cmdCode(t, conn, "XECHO hello", 354)
+	if msg := cmdCode(t, conn, "world", 250); msg != "2.0.0 hello world" {
+		t.Errorf("XECHO replied %q", msg)
+	}
+	cmdCode(t, conn, "NOOP", 250)
+	cmdCode(t, conn, "XUNKNOWN", 500)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Without TLS required, keywords are advertised right away.
+	srv.TLSRequired = false
+	conn = newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO client.example.com", 250); !strings.Contains(msg, "\nXSTATS\n") {
+		t.Errorf("XSTATS not advertised: %q", msg)
+	}
+	if msg := cmdCode(t, conn, "xstats", 250); msg != "2.0.0 messages 3\n2.0.0 bytes 1024" {
+		t.Errorf("XSTATS replied %q", msg)
+	}
+	if helo != "client.example.com" {
+		t.Errorf("Session.Helo() = %q", helo)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
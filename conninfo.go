@@ -0,0 +1,57 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// HandlerTLSError function called when a TLS handshake fails, after STARTTLS
+// or on an implicit TLS listener, for monitoring.
+type HandlerTLSError func(remoteAddr net.Addr, err error)
+
+// ConnInfo describes a client connection. With Server.ConnInfoAddr set, every
+// hook is passed it as remoteAddr, so it also implements net.Addr with the
+// client's address. HandlerMessage gets it as Envelope.Conn and Command
+// handlers with Session.ConnInfo.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	Listener   *Listener            // Listener the connection was accepted on, nil when using Serve
+	TLS        *tls.ConnectionState // Negotiated version, cipher suite, SNI name, ALPN protocol and peer certificates, nil without TLS
+}
+
+// Network returns the network of the client's address.
+func (info *ConnInfo) Network() string {
+	return info.RemoteAddr.Network()
+}
+
+// String returns the client's address.
+func (info *ConnInfo) String() string {
+	return info.RemoteAddr.String()
+}
+
+// The remoteAddr hooks are called with.
+func (s *session) hookAddr() net.Addr {
+	if s.srv.ConnInfoAddr {
+		return s.info
+	}
+	return s.info.RemoteAddr
+}
+
+// Complete a TLS handshake and record the connection state, reporting failures.
+func (s *session) handshake(tlsConn *tls.Conn) error {
+	if s.srv.Timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		if s.srv.HandlerTLSError != nil {
+			s.srv.HandlerTLSError(s.hookAddr(), err)
+		}
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	s.info.TLS = &state
+	return nil
+}
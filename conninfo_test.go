@@ -0,0 +1,127 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestConnInfo(t *testing.T) {
+	var info, envInfo *ConnInfo
+	srv := &Server{
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"smtp"}},
+		ConnInfoAddr: true,
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			info, _ = remoteAddr.(*ConnInfo)
+			return true
+		},
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			envInfo = env.Conn
+			return nil
+		},
+	}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO client.example.com", 250)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "mx.example.com", NextProtos: []string{"smtp"}, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tc := textproto.NewConn(tlsConn)
+	cmdResponse(t, tc, "EHLO client.example.com", 250)
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com>", 250)
+	cmdResponse(t, tc, "RCPT TO:<recipient@example.com>", 250)
+	cmdResponse(t, tc, "DATA", 354)
+	cmdResponse(t, tc, "Subject: test\r\n\r\nTest message.\r\n.", 250)
+	tc.Close()
+
+	if info == nil || info.TLS == nil {
+		t.Fatalf("HandlerRcpt got %+v, want ConnInfo with TLS state", info)
+	}
+	if info.RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("ConnInfo.RemoteAddr = %q, want %q", info.RemoteAddr, conn.LocalAddr())
+	}
+	state := tlsConn.ConnectionState()
+	if info.TLS.Version != state.Version || info.TLS.CipherSuite != state.CipherSuite || info.TLS.ServerName != "mx.example.com" || info.TLS.NegotiatedProtocol != "smtp" {
+		t.Errorf("TLS state %+v", info.TLS)
+	}
+	if envInfo != info {
+		t.Errorf("Envelope.Conn = %p, want the ConnInfo passed to HandlerRcpt %p", envInfo, info)
+	}
+}
+
+func TestConnInfoSessions(t *testing.T) {
+	infos := make(chan *ConnInfo, 2)
+	srv := &Server{ConnInfoAddr: true, HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+		infos <- remoteAddr.(*ConnInfo)
+		return true
+	}}
+
+	// Sessions get their own ConnInfo even when their addresses are equal, and
+	// keep it after the connection is closed.
+	first, second := newConn(t, srv), newConn(t, srv)
+	for _, conn := range []net.Conn{first, second} {
+		cmdCode(t, conn, "EHLO client.example.com", 250)
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	}
+	a, b := <-infos, <-infos
+	first.Close()
+	second.Close()
+	if a == b {
+		t.Error("Sessions share a ConnInfo")
+	}
+	if a.String() != a.RemoteAddr.String() || a.Network() != "pipe" {
+		t.Errorf("ConnInfo address is %s %q", a.Network(), a)
+	}
+}
+
+func TestConnInfoTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make(chan net.Addr, 1)
+	srv := &Server{HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+		addrs <- remoteAddr
+		return true
+	}}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tc := dialListener(t, ln.Addr().String(), false)
+	cmdResponse(t, tc, "EHLO client.example.com", 250)
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com>", 250)
+	cmdResponse(t, tc, "RCPT TO:<recipient@example.com>", 250)
+	tc.Close()
+
+	// Without ConnInfoAddr, handlers get the address of the client's connection.
+	if addr, ok := (<-addrs).(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		t.Errorf("HandlerRcpt got %v, want *net.TCPAddr", addr)
+	}
+}
+
+func TestHandlerTLSError(t *testing.T) {
+	var gotErr error
+	srv := &Server{
+		// Deliberately misconfigure TLS to force a handshake failure.
+		TLSConfig: &tls.Config{},
+		HandlerTLSError: func(remoteAddr net.Addr, err error) {
+			gotErr = err
+		},
+	}
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if tlsConn.Handshake() == nil {
+		t.Fatal("TLS handshake succeeded with empty tls.Config, want failure")
+	}
+	textproto.NewConn(conn).ReadResponse(403)
+	conn.Close()
+
+	if gotErr == nil {
+		t.Error("HandlerTLSError not called")
+	}
+}
@@ -0,0 +1,301 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DSN is a delivery status notification (RFC 3464) for a message that was
+// accepted but could not be delivered to some or all of its recipients.
+type DSN struct {
+	ReportingMTA string         // Hostname of this server
+	Original     *Envelope      // Envelope of the failed message, the DSN is sent to its sender
+	Recipients   []DSNRecipient // Recipients to report on
+	Ret          string         // "FULL" returns the whole message, anything else only its header
+	EnvID        string         // ENVID given with MAIL FROM, if any
+}
+
+// DSNRecipient is the status of a single recipient.
+type DSNRecipient struct {
+	Address           string
+	OriginalRecipient string    // ORCPT given with RCPT TO, if any
+	Action            string    // "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status            string    // Enhanced status code, e.g. "5.1.1"
+	RemoteMTA         string    // Host that reported the error, if any
+	Diagnostic        string    // Reply of the remote host, e.g. "550 5.1.1 User unknown"
+	LastAttempt       time.Time // Time of the last delivery attempt
+}
+
+// Envelope returns the envelope the DSN is sent with: the null sender (MAIL FROM:<>)
+// to the sender of the original message.
+func (d *DSN) Envelope() *Envelope {
+	return &Envelope{From: "", To: []string{d.Original.From}, Received: time.Now()}
+}
+
+// Message builds the multipart/report message, including the original message
+// or its header as the third part.
+func (d *DSN) Message(original io.Reader) ([]byte, error) {
+	orig, err := ioutil.ReadAll(original)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	subject := "Undelivered Mail Returned to Sender"
+	if d.delayed() {
+		subject = "Delayed Mail (still being retried)"
+	}
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", d.ReportingMTA)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", d.Original.From)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	// Human readable explanation.
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", d.ReportingMTA)
+	if d.delayed() {
+		part.Write([]byte("Your message could not be delivered yet to the recipients below.\r\nDelivery will be retried, no action is required.\r\n\r\n"))
+	} else {
+		part.Write([]byte("Your message could not be delivered to the recipients below.\r\n\r\n"))
+	}
+	for _, r := range d.Recipients {
+		fmt.Fprintf(part, "<%s>: %s\r\n", r.Address, r.description())
+	}
+
+	// Machine readable status.
+	part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", d.ReportingMTA)
+	if d.EnvID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", d.EnvID)
+	}
+	if !d.Original.Received.IsZero() {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", d.Original.Received.Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		part.Write([]byte("\r\n"))
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", r.Address)
+		if r.OriginalRecipient != "" {
+			fmt.Fprintf(part, "Original-Recipient: rfc822; %s\r\n", r.OriginalRecipient)
+		}
+		fmt.Fprintf(part, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(part, "Status: %s\r\n", r.Status)
+		if r.RemoteMTA != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", r.RemoteMTA)
+		}
+		if r.Diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", r.Diagnostic)
+		}
+		if !r.LastAttempt.IsZero() {
+			fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", r.LastAttempt.Format(time.RFC1123Z))
+		}
+	}
+
+	// The original message, or only its header unless RET=FULL was asked for.
+	if strings.EqualFold(d.Ret, "FULL") {
+		part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+		if err == nil {
+			_, err = part.Write(orig)
+		}
+	} else {
+		fields, _ := splitMessage(orig)
+		part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+		if err == nil {
+			_, err = part.Write(joinMessage(fields, nil))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A DSN is a delay warning if no recipient failed for good.
+func (d *DSN) delayed() bool {
+	for _, r := range d.Recipients {
+		if r.Action != "delayed" {
+			return false
+		}
+	}
+	return len(d.Recipients) > 0
+}
+
+func (r *DSNRecipient) description() string {
+	if r.Diagnostic != "" {
+		if r.RemoteMTA != "" {
+			return fmt.Sprintf("host %s said: %s", r.RemoteMTA, r.Diagnostic)
+		}
+		return r.Diagnostic
+	}
+	return "delivery status " + r.Status
+}
+
+// Remove a NAME=value parameter from MAIL or RCPT parameters, returning its value.
+func cutValueParam(params string, name string) (rest string, value string, found bool) {
+	fields := strings.Fields(params)
+	kept := fields[:0]
+	for _, f := range fields {
+		if i := strings.IndexByte(f, '='); i != -1 && strings.EqualFold(f[:i], name) {
+			value, found = f[i+1:], true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if !found {
+		return params, "", false
+	}
+	return strings.Join(kept, " "), value, true
+}
+
+// Decode an xtext (RFC 3461 section 4) parameter value.
+func xtextDecode(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '=' {
+			return "", false
+		}
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", false
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", false
+			}
+			c = byte(n)
+			i += 2
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
+
+// Parse the DSN parameters of RCPT (RFC 3461 sections 4.1 and 4.2): NOTIFY
+// and the address of ORCPT. Other parameters are ignored.
+func rcptDSNParams(params string) (notify string, orcpt string, ok bool) {
+	params, notify, hasNotify := cutValueParam(params, "NOTIFY")
+	if hasNotify {
+		notify = strings.ToUpper(notify)
+		if notify != "NEVER" {
+			for _, n := range strings.Split(notify, ",") {
+				if n != "SUCCESS" && n != "FAILURE" && n != "DELAY" {
+					return "", "", false
+				}
+			}
+		}
+	}
+	_, orcpt, hasORCPT := cutValueParam(params, "ORCPT")
+	if hasORCPT {
+		i := strings.IndexByte(orcpt, ';')
+		if i < 1 {
+			return "", "", false
+		}
+		orcpt, ok = xtextDecode(orcpt[i+1:])
+		if !ok || orcpt == "" {
+			return "", "", false
+		}
+	}
+	return notify, orcpt, true
+}
+
+// Remember the DSN parameters of the recipients a RCPT expanded to.
+func (s *session) addRecipientDSN(targets []string, notify string, orcpt string) {
+	for _, to := range targets {
+		if orcpt != "" {
+			if s.orcpt == nil {
+				s.orcpt = make(map[string]string)
+			}
+			s.orcpt[to] = orcpt
+		}
+		if notify != "" {
+			if s.notify == nil {
+				s.notify = make(map[string]string)
+			}
+			s.notify[to] = notify
+		}
+	}
+}
+
+// Reports if the sender asked to be told about failed delivery to the
+// recipient, which is the default without NOTIFY.
+func notifyFailure(env *Envelope, to string) bool {
+	notify, ok := env.Notify[to]
+	if !ok {
+		return true
+	}
+	for _, n := range strings.Split(notify, ",") {
+		if n == "FAILURE" {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounce returns a HandlerFailed that queues a DSN to the sender of every failed
+// message, honoring the RET, ENVID and NOTIFY parameters the sender gave.
+// Messages from the null sender are never bounced, so bounces can't loop.
+func Bounce(q *Queue, hostname string) HandlerFailed {
+	return func(env *Envelope, msg io.Reader, err error) {
+		if env.From == "" {
+			return
+		}
+
+		status, diagnostic := "4.4.7", "Message expired: "+err.Error()
+		if smtpErr, ok := err.(*Error); ok {
+			status = smtpErr.EnhancedCode
+			if status == "" {
+				status = fmt.Sprintf("%d.0.0", smtpErr.Code/100)
+			}
+			diagnostic = smtpErr.Error()
+		}
+
+		d := &DSN{ReportingMTA: hostname, Original: env, Ret: env.Ret, EnvID: env.EnvID}
+		for _, to := range env.To {
+			if !notifyFailure(env, to) {
+				continue
+			}
+			d.Recipients = append(d.Recipients, DSNRecipient{
+				Address:           to,
+				OriginalRecipient: env.ORCPT[to],
+				Action:            "failed",
+				Status:            status,
+				Diagnostic:        diagnostic,
+				LastAttempt:       time.Now(),
+			})
+		}
+		if len(d.Recipients) == 0 {
+			return
+		}
+		bounce, err := d.Message(msg)
+		if err != nil {
+			logf(q.ErrorLog, "smtpd: bounce for message %s: %v", env.ID, err)
+			return
+		}
+		_, err = q.Enqueue(d.Envelope(), bytes.NewReader(bounce))
+		if err != nil {
+			logf(q.ErrorLog, "smtpd: bounce for message %s: %v", env.ID, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+const dsnOriginal = "From: sender@example.com\r\nSubject: test\r\n\r\nSecret body\r\n"
+
+// Parse a DSN into its header and the content of each part.
+func parseDSN(t *testing.T, b []byte) (mail.Header, []string) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Content-Type is %q", m.Header.Get("Content-Type"))
+	}
+
+	var parts []string
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+"\n"+string(b))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("DSN has %d parts, want 3", len(parts))
+	}
+	return m.Header, parts
+}
+
+func TestDSNMessage(t *testing.T) {
+	d := &DSN{
+		ReportingMTA: "mx.example.org",
+		Original:     &Envelope{From: "sender@example.com", To: []string{"a@example.net", "b@example.net"}},
+		EnvID:        "QQ314159",
+		Recipients: []DSNRecipient{
+			{Address: "a@example.net", OriginalRecipient: "alias@example.org", Action: "failed", Status: "5.1.1", RemoteMTA: "mx.example.net", Diagnostic: "550 5.1.1 User unknown"},
+			{Address: "b@example.net", Action: "delayed", Status: "4.4.1"},
+		},
+	}
+	b, err := d.Message(strings.NewReader(dsnOriginal))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, parts := parseDSN(t, b)
+	if header.Get("To") != "<sender@example.com>" || header.Get("Auto-Submitted") != "auto-replied" {
+		t.Errorf("DSN header %v", header)
+	}
+	if !strings.Contains(parts[0], "<a@example.net>: host mx.example.net said: 550 5.1.1 User unknown") {
+		t.Errorf("Text part is %q", parts[0])
+	}
+	for _, want := range []string{
+		"Reporting-MTA: dns; mx.example.org",
+		"Original-Envelope-Id: QQ314159",
+		"Final-Recipient: rfc822; a@example.net\r\nOriginal-Recipient: rfc822; alias@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.net\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown",
+		"Final-Recipient: rfc822; b@example.net\r\nAction: delayed\r\nStatus: 4.4.1",
+	} {
+		if !strings.Contains(parts[1], want) {
+			t.Errorf("Status part doesn't contain %q:\n%s", want, parts[1])
+		}
+	}
+
+	// Only the header is returned by default.
+	if !strings.HasPrefix(parts[2], "text/rfc822-headers\n") || strings.Contains(parts[2], "Secret body") || !strings.Contains(parts[2], "Subject: test") {
+		t.Errorf("Original part is %q", parts[2])
+	}
+
+	d.Ret = "FULL"
+	b, err = d.Message(strings.NewReader(dsnOriginal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, parts = parseDSN(t, b)
+	if parts[2] != "message/rfc822\n"+dsnOriginal {
+		t.Errorf("Original part is %q", parts[2])
+	}
+
+	if env := d.Envelope(); env.From != "" || len(env.To) != 1 || env.To[0] != "sender@example.com" {
+		t.Errorf("DSN envelope %+v, want null sender to sender@example.com", env)
+	}
+}
+
+func TestBounce(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir}
+	startHeldQueue(t, q)
+	defer q.Close()
+	bounce := Bounce(q, "mx.example.org")
+	bounce(&Envelope{From: "sender@example.com", To: []string{"unknown@example.net"}}, strings.NewReader(dsnOriginal), &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"})
+	if n := spooled(t, dir); n != 1 {
+		t.Fatalf("Spool contains %d messages, want 1 bounce", n)
+	}
+
+	// NOTIFY=NEVER recipients aren't reported, RET=FULL returns the whole message.
+	bounce(&Envelope{
+		From:   "sender@example.com",
+		To:     []string{"quiet@example.net"},
+		Notify: map[string]string{"quiet@example.net": "NEVER"},
+	}, strings.NewReader(dsnOriginal), &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"})
+	if n := spooled(t, dir); n != 1 {
+		t.Fatalf("Spool contains %d messages, NOTIFY=NEVER was bounced", n)
+	}
+
+	// Bounces are never bounced.
+	bounce(&Envelope{From: "", To: []string{"sender@example.com"}}, strings.NewReader(dsnOriginal), errors.New("expired"))
+	if n := spooled(t, dir); n != 1 {
+		t.Errorf("Spool contains %d messages, bounce was bounced", n)
+	}
+}
+
+func TestCmdDSNParams(t *testing.T) {
+	var got *Envelope
+	srv := &Server{HandlerMessage: func(env *Envelope, msg io.Reader) error {
+		got = env
+		return nil
+	}}
+	conn := newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO host.example.com", 250); !strings.Contains(msg, "\nDSN\n") {
+		t.Errorf("DSN not advertised: %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=MAYBE", 501)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> ENVID=bad+", 501)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=full ENVID=QQ+2B1 SIZE=100", 250)
+	cmdCode(t, conn, "RCPT TO:<a@example.com> NOTIFY=SOMETIMES", 501)
+	cmdCode(t, conn, "RCPT TO:<a@example.com> NOTIFY=never", 250)
+	cmdCode(t, conn, "RCPT TO:<b@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;B+2Bx@example.com", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: test\r\n\r\nTest message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	if got == nil {
+		t.Fatal("HandlerMessage not called")
+	}
+	if got.Ret != "FULL" || got.EnvID != "QQ+1" {
+		t.Errorf("Ret %q and EnvID %q, want FULL and QQ+1", got.Ret, got.EnvID)
+	}
+	if got.Notify["a@example.com"] != "NEVER" || got.Notify["b@example.com"] != "FAILURE,DELAY" {
+		t.Errorf("Notify %v", got.Notify)
+	}
+	if got.ORCPT["b@example.com"] != "B+x@example.com" {
+		t.Errorf("ORCPT %v", got.ORCPT)
+	}
+}
@@ -0,0 +1,98 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+)
+
+// HandlerETRN function called for ETRN (RFC 1985) from authenticated clients
+// and clients in TrustedNetworks, others get 459. It starts delivery of the
+// messages queued for node: a domain, "@domain" for the domain and its
+// subdomains, or "#name" for a named queue. Return the number of messages
+// whose delivery was started, 0 if none are waiting, or ETRNStarted or
+// ETRNPending when the number is unknown. Return an *Error with code 459 to
+// refuse the node, any other error replies 458.
+type HandlerETRN func(remoteAddr net.Addr, node string) (int, error)
+
+// Message counts a HandlerETRN can return when it can't count the messages.
+const (
+	ETRNStarted = -1 // Queuing started, there may be no messages waiting (250)
+	ETRNPending = -2 // Messages are waiting and their delivery was started (252)
+)
+
+// Handle ETRN (RFC 1985 section 5).
+func (s *session) handleETRN(args string) {
+	if s.gotFrom {
+		s.writef("503 5.5.1 Bad sequence of commands (MAIL transaction in progress)")
+		return
+	}
+	if !validETRNNode(args) {
+		s.writef("501 5.5.4 Syntax error in parameters or arguments")
+		return
+	}
+
+	// Only known clients may start queue runs, like VRFY and EXPN.
+	if !s.trustedClient() {
+		s.writef("459 4.7.1 Node %s not allowed: client not authorized", args)
+		return
+	}
+
+	n, err := s.srv.HandlerETRN(s.hookAddr(), args)
+	if err != nil {
+		if smtpErr, ok := err.(*Error); ok {
+			s.writef("%s", smtpErr.Error())
+			return
+		}
+		s.writef("458 4.3.0 Unable to queue messages for node %s", args)
+		return
+	}
+	switch {
+	case n == 0:
+		s.writef("251 2.0.0 OK no messages waiting for node %s", args)
+	case n == ETRNPending:
+		s.writef("252 2.0.0 OK pending messages for node %s started", args)
+	case n > 0:
+		s.writef("253 2.0.0 OK %d pending messages for node %s started", n, args)
+	default:
+		s.writef("250 2.0.0 OK queuing for node %s started", args)
+	}
+}
+
+// Reports if node is a domain, "@domain" or "#name".
+func validETRNNode(node string) bool {
+	if strings.HasPrefix(node, "#") {
+		name := node[1:]
+		return name != "" && !strings.ContainsAny(name, " \t")
+	}
+	return validDomain(strings.TrimPrefix(node, "@"))
+}
+
+// Reports if domain is a syntactically valid domain name.
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ETRN is a HandlerETRN that flushes the messages queued for a domain, or for
+// a domain and its subdomains with "@domain". Named queues are refused. It
+// reads every envelope in the spool, the server only calls it for
+// authenticated clients and TrustedNetworks.
+func (q *Queue) ETRN(remoteAddr net.Addr, node string) (int, error) {
+	if strings.HasPrefix(node, "#") {
+		return 0, &Error{Code: 459, EnhancedCode: "4.7.1", Message: "Node " + node + " not allowed: named queues are not supported"}
+	}
+	domain := strings.TrimPrefix(node, "@")
+	return q.FlushDomain(domain, domain != node), nil
+}
@@ -0,0 +1,113 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCmdETRN(t *testing.T) {
+	pending := map[string]int{
+		"example.com":  3,
+		"@example.net": 0,
+		"example.org":  ETRNPending,
+		"example.info": ETRNStarted,
+	}
+	srv := &Server{
+		HandlerAuth:  testAuth,
+		AuthInsecure: true,
+		HandlerETRN: func(remoteAddr net.Addr, node string) (int, error) {
+			switch node {
+			case "broken.example":
+				return 0, errors.New("queue unavailable")
+			case "#private":
+				return 0, &Error{Code: 459, EnhancedCode: "4.7.1", Message: "Node #private not allowed"}
+			}
+			return pending[node], nil
+		},
+	}
+	conn := newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO client.example.com", 250); !strings.Contains(msg, "\nETRN\n") {
+		t.Errorf("ETRN not advertised: %q", msg)
+	}
+	// Anonymous clients can't start queue runs.
+	cmdCode(t, conn, "ETRN example.com", 459)
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 235)
+	cmdCode(t, conn, "ETRN example.com", 253)
+	cmdCode(t, conn, "ETRN @example.net", 251)
+	cmdCode(t, conn, "ETRN example.org", 252)
+	cmdCode(t, conn, "ETRN example.info", 250)
+	cmdCode(t, conn, "ETRN broken.example", 458)
+	cmdCode(t, conn, "ETRN #private", 459)
+	cmdCode(t, conn, "ETRN", 501)
+	cmdCode(t, conn, "ETRN bad_domain", 501)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "ETRN example.com", 503)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Not advertised before STARTTLS when TLS is required.
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.TLSRequired = true
+	conn = newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO client.example.com", 250); strings.Contains(msg, "ETRN") {
+		t.Errorf("ETRN advertised before STARTTLS: %q", msg)
+	}
+	cmdCode(t, conn, "ETRN example.com", 530)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Without HandlerETRN, ETRN is unknown or a registered command.
+	conn = newConn(t, &Server{})
+	cmdCode(t, conn, "ETRN example.com", 500)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	conn = newConn(t, &Server{Commands: map[string]*Command{
+		"ETRN": {Keyword: "ETRN", Handler: func(s Session, args string) {
+			s.Reply(250, "", "Custom %s", args)
+		}},
+	}})
+	if msg := cmdCode(t, conn, "ETRN example.com", 250); msg != "Custom example.com" {
+		t.Errorf("ETRN replied %q", msg)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestQueueETRN(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir}
+	startHeldQueue(t, q)
+	for _, to := range [][]string{
+		{"a@example.com"},
+		{"b@mx.example.com", "c@example.org"},
+		{"d@EXAMPLE.COM"},
+		{"e@example.net"},
+	} {
+		if _, err := q.Enqueue(&Envelope{From: "sender@example.org", To: to}, strings.NewReader("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer q.Close()
+
+	for node, want := range map[string]int{
+		"example.com":  2,
+		"@example.com": 3,
+		"example.edu":  0,
+	} {
+		// Messages being delivered aren't counted, wait for the attempts to fail.
+		waitQueued(t, q, 4)
+		if n, err := q.ETRN(nil, node); err != nil || n != want {
+			t.Errorf("ETRN %s = %d, %v, want %d", node, n, err, want)
+		}
+	}
+	if _, err := q.ETRN(nil, "#queue"); err == nil || err.(*Error).Code != 459 {
+		t.Errorf("ETRN #queue = %v, want 459", err)
+	}
+}
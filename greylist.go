@@ -0,0 +1,385 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GreylistRecord tracks a greylisting triplet or an auto-whitelisted client network.
+type GreylistRecord struct {
+	First  time.Time // First time the key was seen
+	Last   time.Time // Last time the key was seen
+	Passed int       // Number of times the key passed greylisting
+}
+
+// GreylistStore persists greylisting records. Implementations must be safe for concurrent use.
+type GreylistStore interface {
+	Get(key string) (rec GreylistRecord, ok bool, err error)
+	Put(key string, rec GreylistRecord) error
+	Delete(key string) error
+
+	// Prune removes every record for which expired returns true.
+	Prune(expired func(key string, rec GreylistRecord) bool) error
+}
+
+// Greylist implements triplet-based greylisting (client network, MAIL FROM, RCPT TO).
+// The first delivery attempt for an unknown triplet is temporarily rejected, and
+// accepted once the client retries after Delay has elapsed.
+// Clients are identified by their /24 (IPv4) or /64 (IPv6) network.
+type Greylist struct {
+	Store           GreylistStore
+	Delay           time.Duration // Minimum time before a retry is accepted, defaults to 5 minutes
+	Expiry          time.Duration // Time a triplet that was never retried is remembered, defaults to 48 hours
+	WhitelistExpiry time.Duration // Time a passed triplet or whitelisted client is remembered after it was last seen, defaults to 35 days
+	AutoWhitelist   int           // Number of successful retries before a client network skips greylisting, 0 disables auto-whitelisting
+
+	now func() time.Time
+}
+
+// NewGreylist creates a Greylist with the default delay and expiry windows.
+func NewGreylist(store GreylistStore) *Greylist {
+	return &Greylist{
+		Store:           store,
+		Delay:           5 * time.Minute,
+		Expiry:          48 * time.Hour,
+		WhitelistExpiry: 35 * 24 * time.Hour,
+	}
+}
+
+// Check records a delivery attempt and reports if it may proceed.
+func (g *Greylist) Check(remoteAddr net.Addr, from string, to string) (pass bool, err error) {
+	now := g.clock()
+	client := greylistClient(remoteAddr)
+
+	if g.AutoWhitelist > 0 {
+		key := "client " + client
+		rec, ok, err := g.Store.Get(key)
+		if err != nil {
+			return false, err
+		}
+		if ok && rec.Passed >= g.AutoWhitelist && !g.expired(rec, now) {
+			rec.Last = now
+			return true, g.Store.Put(key, rec)
+		}
+	}
+
+	key := "triplet " + client + " " + strings.ToLower(from) + " " + strings.ToLower(to)
+	rec, ok, err := g.Store.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	// Unknown or forgotten triplet, start the delay.
+	if !ok || g.expired(rec, now) {
+		return false, g.Store.Put(key, GreylistRecord{First: now, Last: now})
+	}
+
+	// Retried too soon.
+	if rec.Passed == 0 && now.Sub(rec.First) < g.delay() {
+		rec.Last = now
+		return false, g.Store.Put(key, rec)
+	}
+
+	// A successful retry counts towards whitelisting the client network.
+	if rec.Passed == 0 && g.AutoWhitelist > 0 {
+		err = g.whitelist("client "+client, now)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	rec.Passed++
+	rec.Last = now
+	return true, g.Store.Put(key, rec)
+}
+
+// Prune removes expired records from the store.
+// Expired records are ignored by Check, so pruning only reclaims space.
+func (g *Greylist) Prune() error {
+	now := g.clock()
+	return g.Store.Prune(func(key string, rec GreylistRecord) bool {
+		return g.expired(rec, now)
+	})
+}
+
+func (g *Greylist) whitelist(key string, now time.Time) error {
+	rec, ok, err := g.Store.Get(key)
+	if err != nil {
+		return err
+	}
+	if !ok || g.expired(rec, now) {
+		rec = GreylistRecord{First: now}
+	}
+	rec.Passed++
+	rec.Last = now
+	return g.Store.Put(key, rec)
+}
+
+func (g *Greylist) expired(rec GreylistRecord, now time.Time) bool {
+	if rec.Passed == 0 {
+		expiry := g.Expiry
+		if expiry == 0 {
+			expiry = 48 * time.Hour
+		}
+		return now.Sub(rec.First) > expiry
+	}
+	expiry := g.WhitelistExpiry
+	if expiry == 0 {
+		expiry = 35 * 24 * time.Hour
+	}
+	return now.Sub(rec.Last) > expiry
+}
+
+func (g *Greylist) delay() time.Duration {
+	if g.Delay == 0 {
+		return 5 * time.Minute
+	}
+	return g.Delay
+}
+
+func (g *Greylist) clock() time.Time {
+	if g.now != nil {
+		return g.now()
+	}
+	return time.Now()
+}
+
+// Reduce the client address to the network used for greylisting.
+// Large senders retry from different hosts in the same network.
+func greylistClient(remoteAddr net.Addr) string {
+	if remoteAddr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return remoteAddr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// MemoryGreylistStore keeps greylisting records in memory.
+type MemoryGreylistStore struct {
+	mu      sync.RWMutex
+	records map[string]GreylistRecord
+}
+
+// NewMemoryGreylistStore creates an empty in-memory store.
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{records: make(map[string]GreylistRecord)}
+}
+
+// Get returns the record for key.
+func (m *MemoryGreylistStore) Get(key string) (rec GreylistRecord, ok bool, err error) {
+	m.mu.RLock()
+	rec, ok = m.records[key]
+	m.mu.RUnlock()
+	return
+}
+
+// Put saves the record for key.
+func (m *MemoryGreylistStore) Put(key string, rec GreylistRecord) error {
+	m.mu.Lock()
+	m.records[key] = rec
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete removes the record for key.
+func (m *MemoryGreylistStore) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.records, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Prune removes every record for which expired returns true.
+func (m *MemoryGreylistStore) Prune(expired func(key string, rec GreylistRecord) bool) error {
+	m.mu.Lock()
+	for key, rec := range m.records {
+		if expired(key, rec) {
+			delete(m.records, key)
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// FileGreylistStore keeps greylisting records in memory and appends every
+// change to a journal file so they survive a restart. Prune compacts the file.
+type FileGreylistStore struct {
+	MemoryGreylistStore
+	path    string
+	save    sync.Mutex
+	file    *os.File
+	entries int // Journal entries written since the last compaction
+}
+
+// One change in the journal, a nil Record deletes the key.
+type greylistEntry struct {
+	Key    string
+	Record *GreylistRecord `json:",omitempty"`
+}
+
+// NewFileGreylistStore opens the store at path, loading any existing records.
+func NewFileGreylistStore(path string) (*FileGreylistStore, error) {
+	f := &FileGreylistStore{
+		MemoryGreylistStore: MemoryGreylistStore{records: make(map[string]GreylistRecord)},
+		path:                path,
+	}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		dec := json.NewDecoder(file)
+		for {
+			var e greylistEntry
+			err = dec.Decode(&e)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// A crash can leave a partly written last entry behind.
+				break
+			}
+			if e.Record == nil {
+				delete(f.records, e.Key)
+			} else {
+				f.records[e.Key] = *e.Record
+			}
+			f.entries++
+		}
+		file.Close()
+	}
+
+	// Rewrite the journal, which also drops a partly written entry.
+	err = f.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put saves the record for key.
+func (f *FileGreylistStore) Put(key string, rec GreylistRecord) error {
+	// Changes reach the journal in the order they are made in memory.
+	f.save.Lock()
+	defer f.save.Unlock()
+	f.MemoryGreylistStore.Put(key, rec)
+	return f.append(greylistEntry{Key: key, Record: &rec})
+}
+
+// Delete removes the record for key.
+func (f *FileGreylistStore) Delete(key string) error {
+	f.save.Lock()
+	defer f.save.Unlock()
+	f.MemoryGreylistStore.Delete(key)
+	return f.append(greylistEntry{Key: key})
+}
+
+// Prune removes every record for which expired returns true.
+func (f *FileGreylistStore) Prune(expired func(key string, rec GreylistRecord) bool) error {
+	f.save.Lock()
+	defer f.save.Unlock()
+	f.MemoryGreylistStore.Prune(expired)
+	return f.rewrite()
+}
+
+// Close closes the journal file.
+func (f *FileGreylistStore) Close() error {
+	f.save.Lock()
+	defer f.save.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Append a change to the journal, f.save must be held. Records are updated on
+// every RCPT, so they aren't synced: a crash only forgets recent triplets,
+// delaying some mail again.
+func (f *FileGreylistStore) append(e greylistEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		return errors.New("smtpd: greylist store closed")
+	}
+	_, err = f.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	f.entries++
+
+	// Keep the journal from growing without bound when Prune isn't called.
+	f.mu.RLock()
+	n := len(f.records)
+	f.mu.RUnlock()
+	if f.entries > 4*n+1000 {
+		return f.rewrite()
+	}
+	return nil
+}
+
+// Write all records to a temporary file and rename it over the journal,
+// so a crash never leaves a partially compacted store behind. f.save must be
+// held.
+func (f *FileGreylistStore) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	f.mu.RLock()
+	for key, rec := range f.records {
+		rec := rec
+		if err = enc.Encode(greylistEntry{Key: key, Record: &rec}); err != nil {
+			break
+		}
+	}
+	n := len(f.records)
+	f.mu.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The renamed file is the new journal, appends go to its end.
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = tmp
+	f.entries = n
+	return nil
+}
@@ -0,0 +1,196 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGreylistClient(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.17"), Port: 25}, "192.0.2.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 25}, "2001:db8:1:2::/64"},
+		{&net.UnixAddr{Name: "pipe", Net: "unix"}, "pipe"},
+	}
+	for _, tt := range tests {
+		if got := greylistClient(tt.addr); got != tt.want {
+			t.Errorf("greylistClient(%v) returned %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestGreylistCheck(t *testing.T) {
+	now := time.Now()
+	g := NewGreylist(NewMemoryGreylistStore())
+	g.AutoWhitelist = 2
+	g.now = func() time.Time { return now }
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	sameNetwork := &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 25}
+
+	check := func(addr net.Addr, from, to string, want bool) {
+		t.Helper()
+		pass, err := g.Check(addr, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pass != want {
+			t.Errorf("Check(%v, %q, %q) returned %v, want %v", addr, from, to, pass, want)
+		}
+	}
+
+	// First attempt and an early retry are rejected.
+	check(client, "sender@example.com", "one@example.com", false)
+	now = now.Add(time.Minute)
+	check(client, "sender@example.com", "one@example.com", false)
+
+	// A retry after the delay passes, from anywhere in the same network.
+	now = now.Add(5 * time.Minute)
+	check(sameNetwork, "Sender@example.com", "one@example.com", true)
+	check(client, "sender@example.com", "one@example.com", true)
+
+	// One successful retry isn't enough to whitelist the client.
+	check(client, "sender@example.com", "two@example.com", false)
+	now = now.Add(10 * time.Minute)
+	check(client, "sender@example.com", "two@example.com", true)
+
+	// Two successful retries whitelist the client for new triplets.
+	check(client, "other@example.com", "three@example.com", true)
+
+	// Unretried triplets are forgotten after the expiry.
+	other := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25}
+	check(other, "sender@example.com", "one@example.com", false)
+	now = now.Add(49 * time.Hour)
+	check(other, "sender@example.com", "one@example.com", false)
+
+	err := g.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileGreylistStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "greylist.json")
+	store, err := NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := GreylistRecord{First: time.Now().UTC().Truncate(time.Second), Passed: 1}
+	err = store.Put("key", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put("deleted", rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete("deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// A partly written entry left by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Key":"partial","Rec`)
+	f.Close()
+
+	// Records survive reopening the store.
+	store, err = NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := store.Get("key")
+	if err != nil || !ok {
+		t.Fatalf("Get returned %v, %v, want stored record", ok, err)
+	}
+	if !got.First.Equal(rec.First) || got.Passed != rec.Passed {
+		t.Errorf("Get returned %+v, want %+v", got, rec)
+	}
+	if _, ok, _ := store.Get("deleted"); ok {
+		t.Errorf("Get returned a deleted record")
+	}
+
+	err = store.Prune(func(key string, rec GreylistRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get("key"); ok {
+		t.Errorf("Get returned a pruned record")
+	}
+
+	// Concurrent changes are journaled in the order they are applied.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Put("key", GreylistRecord{Passed: i})
+		}(i)
+	}
+	wg.Wait()
+	want, _, _ := store.Get("key")
+	store.Close()
+	store, err = NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := store.Get("key"); got.Passed != want.Passed {
+		t.Errorf("Reopened store has %+v, want %+v", got, want)
+	}
+	store.Close()
+}
+
+func TestCmdRCPTGreylisted(t *testing.T) {
+	g := NewGreylist(NewMemoryGreylistStore())
+	conn := newConn(t, &Server{Greylist: g})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+
+	// The first attempt is temporarily rejected.
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 451)
+
+	// The retry after the delay is accepted.
+	g.now = func() time.Time { return time.Now().Add(time.Hour) }
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestCmdRCPTGreylistAuthenticated(t *testing.T) {
+	conn := newConn(t, &Server{
+		Greylist:     NewGreylist(NewMemoryGreylistStore()),
+		HandlerAuth:  testAuth,
+		AuthInsecure: true,
+	})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 235)
+	cmdCode(t, conn, "MAIL FROM:<user@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
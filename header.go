@@ -0,0 +1,132 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Header fields that may appear at most once (RFC 5322 section 3.6).
+var singletonHeaders = []string{"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Message-Id", "In-Reply-To", "References", "Subject"}
+
+// Header fields holding address lists, and if they may be empty.
+var addressHeaders = map[string]bool{"From": false, "Sender": false, "Reply-To": false, "To": false, "Cc": false, "Bcc": true}
+
+var messageIDRE = regexp.MustCompile(`^<[^<>@\s]+@[^<>@\s]+>$`)
+
+// HeaderValidator checks the header of every message against RFC 5322: exactly
+// one From and Date, valid address lists and Message-ID, no repeated singleton
+// fields and limits on line length and total size. Invalid messages are
+// rejected with 554 5.6.0.
+type HeaderValidator struct {
+	MaxLineLength int    // Maximum length of a header line without CRLF, defaults to 998 (RFC 5322 section 2.1.1)
+	MaxHeaderSize int    // Maximum size of the whole header, defaults to 64 KiB
+	Repair        bool   // Add a missing Date or Message-ID instead of rejecting the message
+	Hostname      string // Domain of generated Message-IDs, defaults to os.Hostname()
+}
+
+func invalidHeader(format string, args ...interface{}) *Error {
+	return &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Invalid message header: " + fmt.Sprintf(format, args...)}
+}
+
+// Validate checks the header of msg, returning the message with any repairs made.
+func (v *HeaderValidator) Validate(msg []byte) ([]byte, error) {
+	maxLine, maxSize := v.MaxLineLength, v.MaxHeaderSize
+	if maxLine == 0 {
+		maxLine = 998
+	}
+	if maxSize == 0 {
+		maxSize = 64 * 1024
+	}
+
+	fields, body := splitMessage(msg)
+	size := len(msg) - len(body)
+	if size > maxSize {
+		return nil, invalidHeader("header exceeds %d bytes", maxSize)
+	}
+	for _, line := range bytes.Split(msg[:size], []byte("\n")) {
+		if len(bytes.TrimRight(line, "\r")) > maxLine {
+			return nil, invalidHeader("line exceeds %d characters", maxLine)
+		}
+	}
+
+	count := make(map[string]int)
+	for _, f := range fields {
+		name := textproto.CanonicalMIMEHeaderKey(f.Name)
+		count[name]++
+		value := strings.TrimSpace(strings.Replace(f.Value, "\r\n", "", -1))
+
+		if allowEmpty, ok := addressHeaders[name]; ok && (value != "" || !allowEmpty) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				return nil, invalidHeader("invalid address in %s", name)
+			}
+			if name == "Sender" && len(list) != 1 {
+				return nil, invalidHeader("Sender must be a single address")
+			}
+		}
+		switch name {
+		case "Date":
+			if _, err := mail.ParseDate(value); err != nil {
+				return nil, invalidHeader("invalid Date")
+			}
+		case "Message-Id":
+			if !messageIDRE.MatchString(value) {
+				return nil, invalidHeader("invalid Message-ID")
+			}
+		}
+	}
+
+	for _, name := range singletonHeaders {
+		if count[name] > 1 {
+			return nil, invalidHeader("more than one %s", name)
+		}
+	}
+	if count["From"] == 0 {
+		return nil, invalidHeader("missing From")
+	}
+
+	repaired := false
+	if count["Date"] == 0 {
+		if !v.Repair {
+			return nil, invalidHeader("missing Date")
+		}
+		fields = append(fields, headerField{"Date", time.Now().Format(time.RFC1123Z)})
+		repaired = true
+	}
+	if count["Message-Id"] == 0 && v.Repair {
+		id, err := newMessageID(v.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, headerField{"Message-ID", id})
+		repaired = true
+	}
+	if repaired {
+		return joinMessage(fields, body), nil
+	}
+	return msg, nil
+}
+
+// Generate a unique Message-ID, hostname defaults to os.Hostname().
+func newMessageID(hostname string) (string, error) {
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+		if hostname == "" {
+			hostname = "localhost"
+		}
+	}
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().Unix(), hex.EncodeToString(b), hostname), nil
+}
@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+const validHeader = "From: Sender <sender@example.com>\r\n" +
+	"To: recipient@example.com, \"Other\" <other@example.com>\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n" +
+	"Message-ID: <123@example.com>\r\n" +
+	"Subject: test\r\n"
+
+func TestHeaderValidator(t *testing.T) {
+	tests := []struct {
+		header string
+		reason string
+	}{
+		{validHeader, ""},
+		{validHeader + "Bcc:\r\nCc: undisclosed-recipients:;\r\n", ""},
+		{strings.Replace(validHeader, "From: Sender <sender@example.com>\r\n", "", 1), "missing From"},
+		{strings.Replace(validHeader, "Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n", "", 1), "missing Date"},
+		{validHeader + "From: other@example.com\r\n", "more than one From"},
+		{validHeader + "subject: again\r\n", "more than one Subject"},
+		{strings.Replace(validHeader, "recipient@example.com", "recipient@@example.com", 1), "invalid address in To"},
+		{strings.Replace(validHeader, "<123@example.com>", "123", 1), "invalid Message-ID"},
+		{strings.Replace(validHeader, "Mon, 2 Jan 2006", "yesterday", 1), "invalid Date"},
+		{validHeader + "Sender: a@example.com, b@example.com\r\n", "Sender must be a single address"},
+		{validHeader + "X-Long: " + strings.Repeat("x", 1000) + "\r\n", "line exceeds 998 characters"},
+	}
+
+	v := &HeaderValidator{}
+	for _, tt := range tests {
+		msg := []byte(tt.header + "\r\nBody\r\n")
+		out, err := v.Validate(msg)
+		if tt.reason == "" {
+			if err != nil || string(out) != string(msg) {
+				t.Errorf("Validate(%q) returned %v", tt.header, err)
+			}
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.Code != 554 || e.EnhancedCode != "5.6.0" || !strings.HasSuffix(e.Message, tt.reason) {
+			t.Errorf("Validate(%q) returned %v, want 554 5.6.0 %s", tt.header, err, tt.reason)
+		}
+	}
+
+	v = &HeaderValidator{MaxHeaderSize: 100}
+	if _, err := v.Validate([]byte(validHeader + "\r\n")); err == nil {
+		t.Error("Header over MaxHeaderSize was accepted")
+	}
+}
+
+func TestHeaderValidatorRepair(t *testing.T) {
+	v := &HeaderValidator{Repair: true, Hostname: "mail.example.com"}
+	out, err := v.Validate([]byte("From: sender@example.com\r\nSubject: test\r\n\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, body := splitMessage(out)
+	if len(fields) != 4 || fields[2].Name != "Date" || fields[3].Name != "Message-ID" || !strings.HasSuffix(fields[3].Value, "@mail.example.com>") {
+		t.Errorf("Repaired header %v", fields)
+	}
+	if string(body) != "Body\r\n" {
+		t.Errorf("Repaired body %q", body)
+	}
+
+	// A repaired message passes validation.
+	if _, err := (&HeaderValidator{}).Validate(out); err != nil {
+		t.Errorf("Repaired message is invalid: %v", err)
+	}
+}
+
+func TestCmdDATAHeaderValidator(t *testing.T) {
+	conn := newConn(t, &Server{HeaderValidator: &HeaderValidator{}})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: no from\r\n\r\nTest message.\r\n.", 554)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
@@ -0,0 +1,237 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close or Shutdown.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// TLSMode is how a Listener uses TLS. Modes other than TLSNone are ignored
+// if the Server has no TLSConfig.
+type TLSMode int
+
+const (
+	TLSOptional        TLSMode = iota // STARTTLS is offered, the default
+	TLSNone                           // STARTTLS is not offered
+	TLSRequireStartTLS                // Every command except NOOP, EHLO, STARTTLS and QUIT needs STARTTLS first
+	TLSImplicit                       // Connections start with a TLS handshake, like SMTPS on port 465
+)
+
+// Listener is an address a Server accepts connections on. All listeners share
+// the Server's handlers, connection limit and lifecycle.
+type Listener struct {
+	Network      string      // "tcp" if empty, or "unix"
+	Addr         string      // Address to listen on, the socket path for "unix"
+	Name         string      // Adopt the socket systemd passed with this name (LISTEN_FDNAMES), falling back to Addr if not socket activated
+	Mode         os.FileMode // Permissions of a Unix socket, if set
+	Owner        string      // User owning a Unix socket, if set
+	Group        string      // Group owning a Unix socket, if set
+	TLS          TLSMode
+	AuthRequired bool // Require AUTH before MAIL
+	Submission   bool // Message submission (RFC 6409), implies AuthRequired
+}
+
+// Maximum number of sessions served at once, the rest wait their turn.
+const maxSessions = 200
+
+// Start tracking a listener, returning false if the server is closed.
+func (srv *Server) trackListener(ln net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrackListener(ln net.Listener) {
+	srv.mu.Lock()
+	delete(srv.listeners, ln)
+	srv.mu.Unlock()
+}
+
+// The semaphore limiting sessions across every listener.
+func (srv *Server) sessionSema() chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sema == nil {
+		srv.sema = make(chan struct{}, maxSessions)
+	}
+	return srv.sema
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// Close stops every listener. Sessions in progress are not interrupted.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.listeners, ln)
+	}
+	return err
+}
+
+// Shutdown stops every listener and waits for sessions in progress to end,
+// or for ctx to be done.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Listen on the listener's address, or adopt its socket from systemd.
+func (srv *Server) listen(l *Listener) (ln net.Listener, err error) {
+	if l.Name != "" {
+		ln, err = srv.activatedListener(l.Name)
+		if err == errNotActivated && l.Addr != "" {
+			ln, err = nil, nil
+		}
+	}
+	if ln == nil && err == nil {
+		switch l.Network {
+		case "", "tcp", "tcp4", "tcp6":
+			network := l.Network
+			if network == "" {
+				network = "tcp"
+			}
+			ln, err = net.Listen(network, l.Addr)
+		case "unix":
+			ln, err = listenUnix(l)
+		default:
+			err = fmt.Errorf("smtpd: unsupported network %q", l.Network)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.TLS == TLSImplicit && srv.TLSConfig != nil {
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+	return ln, nil
+}
+
+// Listen on every listener, then serve them all until one fails or the server
+// is closed. The other listeners are closed when one fails.
+func (srv *Server) listenAndServeAll(listeners []*Listener) error {
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := srv.listen(l)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+
+	errc := make(chan error, len(lns))
+	for i, ln := range lns {
+		go func(ln net.Listener, l *Listener) {
+			errc <- srv.serve(ln, l)
+		}(ln, listeners[i])
+	}
+	err := <-errc
+	if err != ErrServerClosed {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	for range lns[1:] {
+		<-errc
+	}
+	return err
+}
+
+// Accept connections on ln until it fails or the server is closed.
+func (srv *Server) serve(ln net.Listener, l *Listener) error {
+	defer ln.Close()
+	if !srv.trackListener(ln) {
+		return ErrServerClosed
+	}
+	defer srv.untrackListener(ln)
+
+	// Request throttler limits how many clients we're talking to at a time
+	// The rest pool up, waiting their turn
+	sema := srv.sessionSema()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		sema <- struct{}{}
+		srv.sessions.Add(1)
+		session := srv.newSession(conn)
+		session.listener = l
+		session.info.Listener = l
+		go func() {
+			defer srv.sessions.Done()
+			session.serve()
+			<-sema
+		}()
+	}
+}
+
+// Reports if commands other than NOOP, EHLO, STARTTLS and QUIT need TLS.
+func (s *session) tlsRequired() bool {
+	if s.srv.TLSConfig == nil {
+		return false
+	}
+	if s.listener != nil && s.listener.TLS == TLSRequireStartTLS {
+		return true
+	}
+	return s.srv.TLSRequired
+}
+
+// Reports if STARTTLS is offered on the connection.
+func (s *session) startTLSAllowed() bool {
+	return s.srv.TLSConfig != nil && !s.tls && (s.listener == nil || s.listener.TLS != TLSNone)
+}
+
+// Reports if the session is message submission (RFC 6409).
+func (s *session) submission() bool {
+	return s.srv.Submission || s.listener != nil && s.listener.Submission
+}
+
+// Reports if AUTH is needed before MAIL.
+func (s *session) authRequired() bool {
+	return s.submission() || s.listener != nil && s.listener.AuthRequired
+}
@@ -0,0 +1,106 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Dial addr, retrying while the server starts, and read the banner.
+func dialListener(t *testing.T, addr string, implicitTLS bool) *textproto.Conn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if implicitTLS {
+			conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		} else {
+			conn, err = net.Dial("tcp", addr)
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	tc := textproto.NewConn(conn)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func cmdResponse(t *testing.T, tc *textproto.Conn, cmd string, code int) string {
+	if err := tc.PrintfLine(cmd); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := tc.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	return msg
+}
+
+func TestListeners(t *testing.T) {
+	mx, submission, smtps := closedAddr(t), closedAddr(t), closedAddr(t)
+	srv := &Server{
+		Hostname:  "mail.example.com",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Listeners: []*Listener{
+			{Addr: mx},
+			{Addr: submission, TLS: TLSRequireStartTLS, Submission: true},
+			{Addr: smtps, TLS: TLSImplicit, AuthRequired: true},
+		},
+		HandlerAuth: testAuth,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	// STARTTLS is optional and AUTH isn't offered without TLS.
+	tc := dialListener(t, mx, false)
+	if msg := cmdResponse(t, tc, "EHLO client.example.com", 250); !strings.Contains(msg, "STARTTLS") || strings.Contains(msg, "AUTH") {
+		t.Errorf("Port 25 EHLO: %q", msg)
+	}
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com>", 250)
+	tc.Close()
+
+	// STARTTLS is required before anything else.
+	tc = dialListener(t, submission, false)
+	cmdResponse(t, tc, "EHLO client.example.com", 250)
+	cmdResponse(t, tc, "MAIL FROM:<user@example.com>", 530)
+	tc.Close()
+
+	// Implicit TLS offers AUTH straight away and requires it.
+	tc = dialListener(t, smtps, true)
+	if msg := cmdResponse(t, tc, "EHLO client.example.com", 250); strings.Contains(msg, "STARTTLS") || !strings.Contains(msg, "AUTH PLAIN") {
+		t.Errorf("Port 465 EHLO: %q", msg)
+	}
+	cmdResponse(t, tc, "MAIL FROM:<user@example.com>", 530)
+	cmdResponse(t, tc, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 235)
+	cmdResponse(t, tc, "MAIL FROM:<user@example.com>", 250)
+
+	// Shutdown stops the listeners and waits for the open session.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with an open session returned %v", err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("ListenAndServe returned %v", err)
+	}
+	if _, err := net.Dial("tcp", mx); err == nil {
+		t.Error("Listener still accepting after Shutdown")
+	}
+
+	cmdResponse(t, tc, "QUIT", 221)
+	tc.Close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package smtpd
+
+import (
+	"bytes"
+	"strings"
+)
+
+// headerField is a raw message header. Unlike textproto.MIMEHeader the order of
+// the fields is kept, which matters to filters and signatures.
+type headerField struct {
+	Name  string
+	Value string // Value without the leading space, folded lines are kept as is
+}
+
+// Split a raw message into its header fields and body.
+// A message that doesn't start with a header field is treated as all body.
+func splitMessage(msg []byte) (fields []headerField, body []byte) {
+	rest := msg
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		trimmed := bytes.TrimRight(line, "\r\n")
+
+		// Blank line separates the header from the body.
+		if len(trimmed) == 0 {
+			return fields, rest[end:]
+		}
+
+		// Continuation of a folded header.
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += "\r\n" + string(trimmed)
+			rest = rest[end:]
+			continue
+		}
+
+		colon := bytes.IndexByte(trimmed, ':')
+		if colon <= 0 {
+			break
+		}
+		value := strings.TrimPrefix(string(trimmed[colon+1:]), " ")
+		fields = append(fields, headerField{string(trimmed[:colon]), value})
+		rest = rest[end:]
+	}
+
+	if len(fields) == 0 {
+		return nil, msg
+	}
+	return fields, rest
+}
+
+// Join header fields and body back into a raw message.
+func joinMessage(fields []headerField, body []byte) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteString(f.Name)
+		buf.WriteString(": ")
+		buf.WriteString(f.Value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
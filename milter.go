@@ -0,0 +1,302 @@
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Xeoncross/smtpd/milter"
+)
+
+// milterConn is a milter session for the lifetime of an SMTP connection.
+type milterConn struct {
+	*milter.Session
+	accepted bool // Accepted the connection, skip for the rest of the connection
+	done     bool // Accepted the current message, skip until the next transaction
+	closed   bool // The session failed and was closed
+}
+
+// Open a session with every milter and send the connection details.
+// Returns the reply to send instead of the banner if the connection is refused.
+func (s *session) milterConnect() string {
+	for _, c := range s.srv.Milters {
+		m, err := c.Session()
+		if err != nil {
+			if s.srv.MilterFailOpen {
+				continue
+			}
+			return "421 4.7.0 " + s.srv.Hostname + " Service unavailable - try again later"
+		}
+		s.milters = append(s.milters, &milterConn{Session: m})
+	}
+
+	family, port, address := milterAddr(s.conn.RemoteAddr())
+	hostname := s.remoteHost
+	if hostname == "" {
+		hostname = "[" + address + "]"
+	}
+
+	return s.milterStage(true, func(m *milter.Session) (*milter.Action, error) {
+		err := m.Macros('C', "j", s.srv.Hostname, "{daemon_name}", s.srv.Appname)
+		if err != nil {
+			return nil, err
+		}
+		return m.Conn(hostname, family, port, address)
+	})
+}
+
+func (s *session) milterHelo() string {
+	return s.milterStage(true, func(m *milter.Session) (*milter.Action, error) {
+		return m.Helo(s.remoteName)
+	})
+}
+
+func (s *session) milterMail(from string, args []string) string {
+	for _, m := range s.milters {
+		m.done = false
+	}
+	return s.milterStage(false, func(m *milter.Session) (*milter.Action, error) {
+		return m.Mail(from, args...)
+	})
+}
+
+func (s *session) milterRcpt(to string) string {
+	return s.milterStage(false, func(m *milter.Session) (*milter.Action, error) {
+		return m.Rcpt(to)
+	})
+}
+
+func (s *session) milterData() string {
+	return s.milterStage(false, func(m *milter.Session) (*milter.Action, error) {
+		return m.Data()
+	})
+}
+
+// Pass the message through every milter in turn, applying the modifications
+// each one requests. Returns the (modified) message.
+func (s *session) milterMessage(msg []byte) ([]byte, error) {
+	reply := s.milterStage(false, func(m *milter.Session) (*milter.Action, error) {
+		fields, body := splitMessage(msg)
+		for _, f := range fields {
+			act, err := m.Header(f.Name, f.Value)
+			if err != nil || act.Code != milter.ActContinue {
+				return act, err
+			}
+		}
+		act, err := m.EndOfHeaders()
+		if err != nil || act.Code != milter.ActContinue {
+			return act, err
+		}
+		act, err = m.Body(bytes.NewReader(body))
+		if err != nil || act.Code != milter.ActContinue {
+			return act, err
+		}
+
+		act, mods, err := m.End()
+		if err != nil {
+			return nil, err
+		}
+
+		// Later milters see the message as modified by earlier ones.
+		msg = s.milterApply(msg, mods)
+		return act, nil
+	})
+	if reply != "" {
+		return nil, parseReply(reply)
+	}
+
+	// Every recipient was removed, there is nobody to deliver to.
+	if len(s.to) == 0 {
+		s.discard = true
+	}
+	return msg, nil
+}
+
+// Apply milter modifications to the message and the envelope.
+func (s *session) milterApply(msg []byte, mods []milter.Modification) []byte {
+	if len(mods) == 0 {
+		return msg
+	}
+
+	fields, body := splitMessage(msg)
+	var newBody []byte
+	replaceBody := false
+
+	for _, mod := range mods {
+		switch mod.Code {
+		case milter.ModAddHeader:
+			fields = append(fields, headerField{mod.Name, mod.Value})
+		case milter.ModInsHeader:
+			i := mod.Index
+			if i > len(fields) {
+				i = len(fields)
+			}
+			fields = append(fields[:i], append([]headerField{{mod.Name, mod.Value}}, fields[i:]...)...)
+		case milter.ModChgHeader:
+			fields = changeHeader(fields, mod.Name, mod.Index, mod.Value)
+		case milter.ModAddRcpt, milter.ModAddRcptPar:
+			s.milterAddRcpt(mod.Value)
+		case milter.ModDelRcpt:
+			if i := indexFold(s.to, mod.Value); i != -1 {
+				s.to = append(s.to[:i], s.to[i+1:]...)
+			}
+		case milter.ModChgFrom:
+			s.from = mod.Value
+		case milter.ModReplBody:
+			replaceBody = true
+			newBody = append(newBody, mod.Body...)
+		case milter.ModQuarantine:
+			// There is no quarantine, the message is delivered as usual.
+		}
+	}
+
+	if replaceBody {
+		body = newBody
+	}
+	return joinMessage(fields, body)
+}
+
+// Add a recipient requested by a milter. It is subject to the RecipientPolicy
+// and the recipient limit like RCPT, recipients that don't pass are logged and
+// dropped.
+func (s *session) milterAddRcpt(to string) {
+	targets, err := s.recipientTargets(to)
+	if err == nil && !s.recipientsFit(targets) {
+		err = errors.New("too many recipients")
+	}
+	if err != nil {
+		s.srv.logf("smtpd: milter added recipient <%s>: %v", to, err)
+		return
+	}
+	s.addRecipients(to, targets)
+}
+
+// Run a stage on every active milter, stopping at the first that doesn't continue.
+// Returns the reply to send instead of the normal response, or "" to proceed.
+// Connection stages (connect and HELO) accept the whole connection, later stages
+// only the current message.
+func (s *session) milterStage(connStage bool, fn func(m *milter.Session) (*milter.Action, error)) string {
+	for _, m := range s.milters {
+		if m.accepted || m.done || m.closed {
+			continue
+		}
+
+		act, err := fn(m.Session)
+		if err != nil {
+			// The session is unusable after an error.
+			m.Close()
+			m.closed = true
+			if s.srv.MilterFailOpen {
+				continue
+			}
+			return "451 4.7.1 Service unavailable - try again later"
+		}
+
+		switch act.Code {
+		case milter.ActAccept:
+			if connStage {
+				m.accepted = true
+			} else {
+				m.done = true
+			}
+		case milter.ActDiscard:
+			// At the connection stages this applies to every message.
+			if connStage {
+				s.discardConn = true
+			}
+			s.discard = true
+			return ""
+		case milter.ActReject:
+			return "550 5.7.1 Command rejected"
+		case milter.ActTempFail:
+			return "451 4.7.1 Service unavailable - try again later"
+		case milter.ActReplyCode:
+			return act.Reply
+		}
+	}
+	return ""
+}
+
+func (s *session) milterAbort() {
+	for _, m := range s.milters {
+		if !m.accepted && !m.closed {
+			m.Abort()
+		}
+		m.done = false
+	}
+}
+
+func (s *session) milterClose() {
+	for _, m := range s.milters {
+		if !m.closed {
+			m.Close()
+		}
+	}
+	s.milters = nil
+}
+
+// Describe the client address the way milters expect it.
+func milterAddr(addr net.Addr) (family byte, port uint16, address string) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.IP.To4() != nil {
+			return '4', uint16(a.Port), a.IP.String()
+		}
+		return '6', uint16(a.Port), a.IP.String()
+	case *net.UnixAddr:
+		return 'L', 0, a.Name
+	}
+	return 'U', 0, ""
+}
+
+// Change the index'th (1-based) occurrence of the named header, deleting it if
+// value is empty. A missing header is appended instead.
+func changeHeader(fields []headerField, name string, index int, value string) []headerField {
+	n := 0
+	for i, f := range fields {
+		if !strings.EqualFold(f.Name, name) {
+			continue
+		}
+		n++
+		if n < index && index > 0 {
+			continue
+		}
+		if value == "" {
+			return append(fields[:i], fields[i+1:]...)
+		}
+		fields[i].Value = value
+		return fields
+	}
+	if value != "" {
+		fields = append(fields, headerField{name, value})
+	}
+	return fields
+}
+
+// Parse an SMTP reply such as "550 5.7.1 Go away" into an Error.
+func parseReply(reply string) *Error {
+	err := &Error{Code: 451, Message: reply}
+	parts := strings.SplitN(reply, " ", 3)
+	code, convErr := strconv.Atoi(parts[0])
+	if convErr != nil {
+		return err
+	}
+	err.Code = code
+	err.Message = strings.Join(parts[1:], " ")
+	if len(parts) == 3 && enhancedCodeRE.MatchString(parts[1]) {
+		err.EnhancedCode = parts[1]
+		err.Message = parts[2]
+	}
+	return err
+}
+
+func indexFold(list []string, s string) int {
+	for i, v := range list {
+		if strings.EqualFold(v, s) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,463 @@
+// Package milter implements the MTA side of the Sendmail milter protocol (version 6),
+// so mail filters such as rspamd, opendkim or clamav-milter can inspect and modify
+// messages received by an SMTP server.
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands sent to the milter.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdBodyEOB = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// Response codes sent by the milter.
+const (
+	ActAccept    = 'a' // Accept the message or connection without further filtering
+	ActContinue  = 'c' // Continue to the next stage
+	ActDiscard   = 'd' // Accept the message but silently discard it
+	ActReject    = 'r' // Reject the command
+	ActTempFail  = 't' // Reject the command with a temporary failure
+	ActReplyCode = 'y' // Reject the command with the reply in Action.Reply
+	ActSkip      = 's' // Skip the rest of the body chunks
+
+	actProgress = 'p'
+	actOptNeg   = 'O'
+)
+
+// Modifications requested by the milter at the end of the message.
+const (
+	ModAddHeader  = 'h' // Append a header
+	ModInsHeader  = 'i' // Insert a header at Index
+	ModChgHeader  = 'm' // Change the Index'th occurrence of a header, or delete it if Value is empty
+	ModAddRcpt    = '+' // Add a recipient
+	ModAddRcptPar = '2' // Add a recipient with ESMTP arguments
+	ModDelRcpt    = '-' // Remove a recipient
+	ModChgFrom    = 'e' // Change the envelope sender
+	ModReplBody   = 'b' // Replace the body, sent in one or more chunks
+	ModQuarantine = 'q' // Quarantine the message
+)
+
+// Actions (SMFIF_*) the MTA allows the milter to perform.
+const (
+	OptAddHeaders = 1 << iota
+	OptChangeBody
+	OptAddRcpt
+	OptDelRcpt
+	OptChangeHeaders
+	OptQuarantine
+	OptChangeFrom
+	OptAddRcptPar
+)
+
+// Action required for each modification.
+var modActions = map[byte]uint32{
+	ModAddHeader:  OptAddHeaders,
+	ModInsHeader:  OptAddHeaders,
+	ModChgHeader:  OptChangeHeaders,
+	ModAddRcpt:    OptAddRcpt,
+	ModAddRcptPar: OptAddRcptPar,
+	ModDelRcpt:    OptDelRcpt,
+	ModChgFrom:    OptChangeFrom,
+	ModReplBody:   OptChangeBody,
+	ModQuarantine: OptQuarantine,
+}
+
+// Protocol flags (SMFIP_*) the milter uses to skip stages or replies.
+const (
+	optNoConnect = 1 << iota
+	optNoHelo
+	optNoMail
+	optNoRcpt
+	optNoBody
+	optNoHeaders
+	optNoEOH
+	optNoHeaderReply
+	optNoUnknown
+	optNoData
+	optSkip
+	optRcptRej
+	optNoConnectReply
+	optNoHeloReply
+	optNoMailReply
+	optNoRcptReply
+	optNoDataReply
+	optNoUnknownReply
+	optNoEOHReply
+	optNoBodyReply
+	optHeaderLeadingSpace
+)
+
+const (
+	version = 6
+
+	// Protocol steps and no-reply flags this client understands.
+	protocolMask = optNoConnect | optNoHelo | optNoMail | optNoRcpt | optNoBody | optNoHeaders | optNoEOH |
+		optNoHeaderReply | optNoData | optSkip | optNoConnectReply | optNoHeloReply | optNoMailReply |
+		optNoRcptReply | optNoDataReply | optNoEOHReply | optNoBodyReply
+
+	// MaxChunk is the largest body chunk sent in a single packet.
+	MaxChunk = 65535
+
+	maxPacket = 1 << 20
+)
+
+// ErrProtocol is returned when the milter sends an unexpected or malformed response.
+var ErrProtocol = errors.New("milter: protocol error")
+
+// Action is the milter's response to a stage of the SMTP conversation.
+type Action struct {
+	Code  byte   // One of the Act* constants
+	Reply string // SMTP reply for ActReplyCode, e.g. "550 5.7.1 Spam detected"
+}
+
+// Modification is a change to the message requested at the end of the message.
+type Modification struct {
+	Code  byte   // One of the Mod* constants
+	Index int    // Header index for ModInsHeader and ModChgHeader
+	Name  string // Header name
+	Value string // Header value, recipient, sender or quarantine reason
+	Args  string // ESMTP arguments for ModAddRcptPar and ModChgFrom
+	Body  []byte // Body chunk for ModReplBody
+}
+
+// Client connects to a milter listening on a TCP or Unix socket.
+type Client struct {
+	Network string        // "tcp" or "unix"
+	Address string        // e.g. "127.0.0.1:11332" or "/run/opendkim/opendkim.sock"
+	Timeout time.Duration // Connect and per-response timeout, defaults to 10 seconds
+	Actions uint32        // Actions the milter may perform (Opt*), defaults to all supported
+}
+
+// Session is a single connection to a milter, used for one SMTP connection.
+type Session struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	timeout  time.Duration
+	actions  uint32
+	protocol uint32
+	skipBody bool
+}
+
+// Session dials the milter and negotiates the protocol options.
+func (c *Client) Session() (*Session, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	conn, err := net.DialTimeout(network, c.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+
+	actions := c.Actions
+	if actions == 0 {
+		actions = OptAddHeaders | OptChangeBody | OptAddRcpt | OptDelRcpt | OptChangeHeaders | OptQuarantine | OptChangeFrom | OptAddRcptPar
+	}
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, version)
+	binary.BigEndian.PutUint32(data[4:], actions)
+	binary.BigEndian.PutUint32(data[8:], protocolMask)
+	err = s.write(cmdOptNeg, data)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	code, data, err := s.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if code != actOptNeg || len(data) < 12 {
+		conn.Close()
+		return nil, ErrProtocol
+	}
+	if v := binary.BigEndian.Uint32(data); v < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("milter: unsupported protocol version %d", v)
+	}
+
+	// The milter may only ask for what we offered.
+	s.actions = binary.BigEndian.Uint32(data[4:]) & actions
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & protocolMask
+	return s, nil
+}
+
+// Macros sends macro definitions for the stage identified by the command code,
+// e.g. 'C' for connect. The key/value pairs are given as alternating strings.
+func (s *Session) Macros(stage byte, kv ...string) error {
+	if len(kv) == 0 {
+		return nil
+	}
+	data := []byte{stage}
+	for _, v := range kv {
+		data = appendString(data, v)
+	}
+	return s.write(cmdMacro, data)
+}
+
+// Conn sends the connection information. family is '4', '6', 'L' (Unix socket) or 'U' (unknown).
+func (s *Session) Conn(hostname string, family byte, port uint16, address string) (*Action, error) {
+	data := appendString(nil, hostname)
+	data = append(data, family)
+	if family != 'U' {
+		data = append(data, byte(port>>8), byte(port))
+		data = appendString(data, address)
+	}
+	return s.command(cmdConnect, data, optNoConnect, optNoConnectReply)
+}
+
+// Helo sends the HELO/EHLO name.
+func (s *Session) Helo(name string) (*Action, error) {
+	return s.command(cmdHelo, appendString(nil, name), optNoHelo, optNoHeloReply)
+}
+
+// Mail sends the envelope sender and its ESMTP arguments.
+func (s *Session) Mail(from string, args ...string) (*Action, error) {
+	s.skipBody = false
+	data := appendString(nil, "<"+from+">")
+	for _, arg := range args {
+		data = appendString(data, arg)
+	}
+	return s.command(cmdMail, data, optNoMail, optNoMailReply)
+}
+
+// Rcpt sends an envelope recipient and its ESMTP arguments.
+func (s *Session) Rcpt(to string, args ...string) (*Action, error) {
+	data := appendString(nil, "<"+to+">")
+	for _, arg := range args {
+		data = appendString(data, arg)
+	}
+	return s.command(cmdRcpt, data, optNoRcpt, optNoRcptReply)
+}
+
+// Data signals the start of the DATA command.
+func (s *Session) Data() (*Action, error) {
+	return s.command(cmdData, nil, optNoData, optNoDataReply)
+}
+
+// Header sends a single message header.
+func (s *Session) Header(name string, value string) (*Action, error) {
+	data := appendString(nil, name)
+	data = appendString(data, value)
+	return s.command(cmdHeader, data, optNoHeaders, optNoHeaderReply)
+}
+
+// EndOfHeaders signals that all headers have been sent.
+func (s *Session) EndOfHeaders() (*Action, error) {
+	return s.command(cmdEOH, nil, optNoEOH, optNoEOHReply)
+}
+
+// Body sends the message body in chunks. It stops early if the milter
+// responds with anything other than continue.
+func (s *Session) Body(r io.Reader) (*Action, error) {
+	buf := make([]byte, MaxChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !s.skipBody {
+			act, cmdErr := s.command(cmdBody, buf[:n], optNoBody, optNoBodyReply)
+			if cmdErr != nil {
+				return nil, cmdErr
+			}
+			if act.Code == ActSkip {
+				s.skipBody = true
+			} else if act.Code != ActContinue {
+				return act, nil
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &Action{Code: ActContinue}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// End signals the end of the message and returns the final action together
+// with any modifications the milter requested.
+func (s *Session) End() (act *Action, mods []Modification, err error) {
+	err = s.write(cmdBodyEOB, nil)
+	if err != nil {
+		return
+	}
+	for {
+		var code byte
+		var data []byte
+		code, data, err = s.read()
+		if err != nil {
+			return
+		}
+		switch code {
+		case ModAddHeader, ModInsHeader, ModChgHeader, ModAddRcpt, ModAddRcptPar, ModDelRcpt, ModChgFrom, ModReplBody, ModQuarantine:
+			var mod Modification
+			mod, err = parseModification(code, data)
+			if err != nil {
+				return
+			}
+			// Ignore modifications the milter didn't negotiate.
+			if s.actions&modActions[code] != 0 {
+				mods = append(mods, mod)
+			}
+		default:
+			act, err = parseAction(code, data)
+			return
+		}
+	}
+}
+
+// Abort resets the milter to the state after HELO, discarding the current message.
+func (s *Session) Abort() error {
+	s.skipBody = false
+	return s.write(cmdAbort, nil)
+}
+
+// Close ends the session and closes the connection.
+func (s *Session) Close() error {
+	s.write(cmdQuit, nil)
+	return s.conn.Close()
+}
+
+// Send a command and wait for the response, unless the milter opted out of
+// the stage (skip) or its reply (noReply) during negotiation.
+func (s *Session) command(code byte, data []byte, skip uint32, noReply uint32) (*Action, error) {
+	if s.protocol&skip != 0 {
+		return &Action{Code: ActContinue}, nil
+	}
+	err := s.write(code, data)
+	if err != nil {
+		return nil, err
+	}
+	if s.protocol&noReply != 0 {
+		return &Action{Code: ActContinue}, nil
+	}
+
+	rcode, rdata, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return parseAction(rcode, rdata)
+}
+
+func (s *Session) write(code byte, data []byte) error {
+	err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return err
+	}
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = code
+	copy(packet[5:], data)
+	_, err = s.conn.Write(packet)
+	return err
+}
+
+// Read the next packet, skipping progress notifications which only extend the timeout.
+func (s *Session) read() (code byte, data []byte, err error) {
+	for {
+		err = s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		if err != nil {
+			return
+		}
+		var size uint32
+		err = binary.Read(s.r, binary.BigEndian, &size)
+		if err != nil {
+			return
+		}
+		if size == 0 || size > maxPacket {
+			return 0, nil, ErrProtocol
+		}
+		packet := make([]byte, size)
+		_, err = io.ReadFull(s.r, packet)
+		if err != nil {
+			return
+		}
+		if packet[0] != actProgress {
+			return packet[0], packet[1:], nil
+		}
+	}
+}
+
+func parseAction(code byte, data []byte) (*Action, error) {
+	switch code {
+	case ActAccept, ActContinue, ActDiscard, ActReject, ActTempFail, ActSkip:
+		return &Action{Code: code}, nil
+	case ActReplyCode:
+		reply := string(bytes.TrimRight(data, "\x00"))
+		if len(reply) < 3 {
+			return nil, ErrProtocol
+		}
+		if n, err := strconv.Atoi(reply[:3]); err != nil || n < 400 || n > 599 {
+			return nil, ErrProtocol
+		}
+		return &Action{Code: code, Reply: reply}, nil
+	}
+	return nil, ErrProtocol
+}
+
+func parseModification(code byte, data []byte) (mod Modification, err error) {
+	mod.Code = code
+	switch code {
+	case ModReplBody:
+		mod.Body = data
+		return
+	case ModInsHeader, ModChgHeader:
+		if len(data) < 4 {
+			return mod, ErrProtocol
+		}
+		mod.Index = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	switch code {
+	case ModAddHeader, ModInsHeader, ModChgHeader:
+		if len(fields) != 2 {
+			return mod, ErrProtocol
+		}
+		mod.Name, mod.Value = fields[0], fields[1]
+	case ModAddRcpt, ModAddRcptPar, ModDelRcpt, ModChgFrom:
+		mod.Value = strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+		if len(fields) > 1 {
+			mod.Args = fields[1]
+		}
+	default:
+		mod.Value = fields[0]
+	}
+	return
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
@@ -0,0 +1,170 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type packet struct {
+	code byte
+	data []byte
+}
+
+// fakeMilter accepts a single connection, negotiates the given protocol flags
+// and answers every command that expects a reply using respond.
+func fakeMilter(t *testing.T, protocol uint32, respond func(code byte, data []byte) []packet) (*Client, chan packet) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan packet, 100)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		write := func(p packet) {
+			buf := make([]byte, 5+len(p.data))
+			binary.BigEndian.PutUint32(buf, uint32(len(p.data)+1))
+			buf[4] = p.code
+			copy(buf[5:], p.data)
+			conn.Write(buf)
+		}
+
+		for {
+			var size uint32
+			if binary.Read(r, binary.BigEndian, &size) != nil {
+				close(received)
+				return
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				close(received)
+				return
+			}
+			p := packet{buf[0], buf[1:]}
+			received <- p
+
+			switch p.code {
+			case cmdOptNeg:
+				data := make([]byte, 12)
+				binary.BigEndian.PutUint32(data, version)
+				copy(data[4:8], p.data[4:8])
+				binary.BigEndian.PutUint32(data[8:], protocol)
+				write(packet{actOptNeg, data})
+			case cmdMacro, cmdAbort:
+			case cmdQuit:
+				close(received)
+				return
+			default:
+				for _, reply := range respond(p.code, p.data) {
+					write(reply)
+				}
+			}
+		}
+	}()
+
+	return &Client{Address: ln.Addr().String()}, received
+}
+
+func TestSession(t *testing.T) {
+	client, received := fakeMilter(t, optNoHelo, func(code byte, data []byte) []packet {
+		switch code {
+		case cmdRcpt:
+			if strings.Contains(string(data), "spam") {
+				return []packet{{ActReplyCode, []byte("550 5.7.1 Go away\x00")}}
+			}
+		case cmdBodyEOB:
+			return []packet{
+				{actProgress, nil},
+				{ModAddHeader, []byte("X-Milter\x00yes\x00")},
+				{ModChgHeader, []byte{0, 0, 0, 1, 'S', 'u', 'b', 'j', 'e', 'c', 't', 0, 0}},
+				{ModAddRcpt, []byte("<extra@example.com>\x00")},
+				{ActAccept, nil},
+			}
+		}
+		return []packet{{ActContinue, nil}}
+	})
+
+	s, err := client.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-received // OptNeg
+
+	expect := func(act *Action, err error, code byte) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Code != code {
+			t.Fatalf("Action code is %q, want %q", act.Code, code)
+		}
+	}
+
+	act, err := s.Conn("host.example.com", '4', 25, "192.0.2.1")
+	expect(act, err, ActContinue)
+	if p := <-received; p.code != cmdConnect {
+		t.Errorf("Milter received %q, want connect", p.code)
+	}
+
+	// HELO was skipped during negotiation so it must not be sent.
+	act, err = s.Helo("host.example.com")
+	expect(act, err, ActContinue)
+
+	act, err = s.Mail("sender@example.com", "SIZE=100")
+	expect(act, err, ActContinue)
+	if p := <-received; p.code != cmdMail || string(p.data) != "<sender@example.com>\x00SIZE=100\x00" {
+		t.Errorf("Milter received %q %q, want MAIL", p.code, p.data)
+	}
+
+	act, err = s.Rcpt("spam@example.com")
+	expect(act, err, ActReplyCode)
+	if act.Reply != "550 5.7.1 Go away" {
+		t.Errorf("Reply is %q, want %q", act.Reply, "550 5.7.1 Go away")
+	}
+	<-received
+
+	act, err = s.Header("Subject", "Hello")
+	expect(act, err, ActContinue)
+	act, err = s.EndOfHeaders()
+	expect(act, err, ActContinue)
+	act, err = s.Body(strings.NewReader(strings.Repeat("x", MaxChunk+1)))
+	expect(act, err, ActContinue)
+
+	act, mods, err := s.End()
+	expect(act, err, ActAccept)
+	if len(mods) != 3 {
+		t.Fatalf("End returned %d modifications, want 3", len(mods))
+	}
+	if mods[0].Code != ModAddHeader || mods[0].Name != "X-Milter" || mods[0].Value != "yes" {
+		t.Errorf("Modification is %+v, want X-Milter header", mods[0])
+	}
+	if mods[1].Code != ModChgHeader || mods[1].Index != 1 || mods[1].Name != "Subject" || mods[1].Value != "" {
+		t.Errorf("Modification is %+v, want Subject removal", mods[1])
+	}
+	if mods[2].Code != ModAddRcpt || mods[2].Value != "extra@example.com" {
+		t.Errorf("Modification is %+v, want added recipient", mods[2])
+	}
+
+	// Header, EOH, two body chunks and EOB.
+	for _, code := range []byte{cmdHeader, cmdEOH, cmdBody, cmdBody, cmdBodyEOB} {
+		if p := <-received; p.code != code {
+			t.Errorf("Milter received %q, want %q", p.code, code)
+		}
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/Xeoncross/smtpd/milter"
+)
+
+// Start a fake milter that answers every command with the packets returned by
+// respond. Negotiation, macros, abort and quit are handled internally.
+func startMilter(t *testing.T, respond func(code byte, data string) [][]byte) *milter.Client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		for {
+			var size uint32
+			if binary.Read(r, binary.BigEndian, &size) != nil {
+				return
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+
+			var replies [][]byte
+			switch buf[0] {
+			case 'O':
+				replies = [][]byte{append([]byte{'O', 0, 0, 0, 6}, append(buf[5:9], 0, 0, 0, 0)...)}
+			case 'D', 'A':
+			case 'Q':
+				return
+			default:
+				replies = respond(buf[0], string(buf[1:]))
+			}
+
+			for _, reply := range replies {
+				packet := make([]byte, 4, 4+len(reply))
+				binary.BigEndian.PutUint32(packet, uint32(len(reply)))
+				conn.Write(append(packet, reply...))
+			}
+		}
+	}()
+
+	return &milter.Client{Address: ln.Addr().String()}
+}
+
+func TestMilter(t *testing.T) {
+	var gotTo []string
+	var gotHeader textproto.MIMEHeader
+	var gotBody string
+
+	server := &Server{
+		Handler: func(bytesRead int, remoteAddr net.Addr, from string, to []string, header textproto.MIMEHeader, body io.Reader) error {
+			gotTo = to
+			gotHeader = header
+			b, err := ioutil.ReadAll(body)
+			gotBody = string(b)
+			return err
+		},
+	}
+	server.Milters = []*milter.Client{startMilter(t, func(code byte, data string) [][]byte {
+		switch code {
+		case 'R':
+			if strings.Contains(data, "blocked") {
+				return [][]byte{[]byte("y550 5.7.1 Recipient blocked (100% sure)\x00")}
+			}
+		case 'L':
+			if strings.HasPrefix(data, "Subject\x00spam") {
+				return [][]byte{{'r'}}
+			}
+		case 'E':
+			return [][]byte{
+				[]byte("hX-Milter\x00checked\x00"),
+				[]byte("+<added@example.com>\x00"),
+				[]byte("-<recipient@example.com>\x00"),
+				[]byte("bReplaced body\r\n"),
+				{'c'},
+			}
+		}
+		return [][]byte{{'c'}}
+	})}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+
+	// Recipients can be rejected with a custom reply.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	msg := cmdCode(t, conn, "RCPT TO:<blocked@example.com>", 550)
+	if msg != "5.7.1 Recipient blocked (100% sure)" {
+		t.Errorf("RCPT reply is %q, want milter reply", msg)
+	}
+
+	// Modifications are applied to the message and recipients.
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: hello\r\n"+mimeHeaders+"Test message.\r\n.", 250)
+
+	if len(gotTo) != 1 || gotTo[0] != "added@example.com" {
+		t.Errorf("Handler received recipients %v, want [added@example.com]", gotTo)
+	}
+	if gotHeader.Get("X-Milter") != "checked" || gotHeader.Get("Subject") != "hello" {
+		t.Errorf("Handler received header %v, want milter header added", gotHeader)
+	}
+	if gotBody != "Replaced body\r\n" {
+		t.Errorf("Handler received body %q, want replaced body", gotBody)
+	}
+
+	// Rejected content fails the DATA command.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: spam\r\n"+mimeHeaders+"Test message.\r\n.", 550)
+
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestMilterAddRcptPolicy(t *testing.T) {
+	store := NewMemoryRecipientStore("example.com")
+	store.AddMailbox("recipient@example.com")
+	store.AddMailbox("added@example.com")
+
+	var gotTo []string
+	server := &Server{
+		ErrorLog:   log.New(ioutil.Discard, "", 0),
+		Recipients: &RecipientPolicy{Store: store},
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			gotTo = env.To
+			return nil
+		},
+	}
+	server.Milters = []*milter.Client{startMilter(t, func(code byte, data string) [][]byte {
+		if code == 'E' {
+			return [][]byte{
+				[]byte("+<added@example.com>\x00"),
+				[]byte("+<unknown@example.com>\x00"),
+				{'c'},
+			}
+		}
+		return [][]byte{{'c'}}
+	})}
+
+	// Recipients added by the milter go through the RecipientPolicy.
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: hello\r\n\r\nTest message.\r\n.", 250)
+	if strings.Join(gotTo, " ") != "recipient@example.com added@example.com" {
+		t.Errorf("Handler received recipients %v, want the unknown one dropped", gotTo)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestMilterHeloDiscard(t *testing.T) {
+	handled := 0
+	server := &Server{
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			handled++
+			return nil
+		},
+	}
+	server.Milters = []*milter.Client{startMilter(t, func(code byte, data string) [][]byte {
+		if code == 'H' {
+			return [][]byte{{'d'}}
+		}
+		return [][]byte{{'c'}}
+	})}
+
+	// A discard at HELO applies to every message of the connection.
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	for i := 0; i < 2; i++ {
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+		cmdCode(t, conn, "DATA", 354)
+		cmdCode(t, conn, "Subject: hello\r\n\r\nTest message.\r\n.", 250)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	if handled != 0 {
+		t.Errorf("HandlerMessage called %d times, want discarded messages", handled)
+	}
+}
+
+func TestMilterConnectRejected(t *testing.T) {
+	for reply, want := range map[string]int{
+		"t":                              421,
+		"y450 4.7.1 Try again later\x00": 421,
+		"r":                              554,
+	} {
+		reply := reply
+		server := &Server{Milters: []*milter.Client{startMilter(t, func(code byte, data string) [][]byte {
+			if code == 'C' {
+				return [][]byte{[]byte(reply)}
+			}
+			return [][]byte{{'c'}}
+		})}}
+		clientConn, serverConn := net.Pipe()
+		go server.newSession(serverConn).serve()
+		code, msg, err := textproto.NewConn(clientConn).ReadCodeLine(want)
+		if err != nil {
+			t.Errorf("Milter reply %q: banner is %d %s, want %d: %v", reply, code, msg, want, err)
+		}
+		clientConn.Close()
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// Without fail open, the connection is refused until the milter is back.
+	server := &Server{Milters: []*milter.Client{{Address: addr}}}
+	clientConn, serverConn := net.Pipe()
+	go server.newSession(serverConn).serve()
+	code, _, err := textproto.NewConn(clientConn).ReadCodeLine(421)
+	if err != nil {
+		t.Errorf("Banner code is %d, want 421: %v", code, err)
+	}
+	clientConn.Close()
+
+	// With fail open, the milter is skipped.
+	server.MilterFailOpen = true
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestSplitMessage(t *testing.T) {
+	msg := "From: sender@example.com\r\nSubject: folded\r\n line\r\n\r\nBody\r\n"
+	fields, body := splitMessage([]byte(msg))
+	if len(fields) != 2 || fields[1].Value != "folded\r\n line" {
+		t.Errorf("splitMessage returned fields %q, want 2 with folded subject", fields)
+	}
+	if string(body) != "Body\r\n" {
+		t.Errorf("splitMessage returned body %q, want %q", body, "Body\r\n")
+	}
+	if joined := string(joinMessage(fields, body)); joined != msg {
+		t.Errorf("joinMessage returned %q, want %q", joined, msg)
+	}
+
+	fields = changeHeader(fields, "subject", 1, "")
+	if len(fields) != 1 {
+		t.Errorf("changeHeader didn't delete the header: %q", fields)
+	}
+}
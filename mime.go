@@ -0,0 +1,213 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path"
+	"strings"
+)
+
+var (
+	errTooManyParts = &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Message has too many MIME parts"}
+	errMIMETooDeep  = &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Message has too deeply nested MIME parts"}
+)
+
+// mimePart is a leaf part of a message, with its transfer encoding decoded.
+type mimePart struct {
+	Header      textproto.MIMEHeader
+	MediaType   string            // Lowercase, "text/plain" if missing or invalid
+	Params      map[string]string // Content-Type parameters
+	Disposition string            // "inline", "attachment" or empty
+	Filename    string            // Decoded (RFC 2047 and RFC 2231), without any directory
+	Body        io.Reader
+}
+
+// Attachment reports if the part is an attachment rather than message text.
+func (p *mimePart) Attachment() bool {
+	if p.Disposition == "attachment" || p.Filename != "" {
+		return true
+	}
+	return !strings.HasPrefix(p.MediaType, "text/") && !strings.HasPrefix(p.MediaType, "message/")
+}
+
+// mimeWalker walks the parts of a message, enforcing limits on the structure.
+type mimeWalker struct {
+	MaxParts int // Maximum number of parts, including multipart containers, 0 for no limit
+	MaxDepth int // Maximum multipart nesting, 0 for no limit
+
+	parts int
+}
+
+// Read the header of a raw message and walk its parts without limits.
+func walkMessage(r io.Reader, fn func(p *mimePart) error) error {
+	return (&mimeWalker{}).walkMessage(r, fn)
+}
+
+// Read the header of a raw message and walk its parts.
+func (w *mimeWalker) walkMessage(r io.Reader, fn func(p *mimePart) error) error {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return w.walk(header, tp.R, 0, fn)
+}
+
+// Call fn for every leaf part, descending into multipart parts.
+func (w *mimeWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int, fn func(p *mimePart) error) error {
+	w.parts++
+	if w.MaxParts > 0 && w.parts > w.MaxParts {
+		return errTooManyParts
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if w.MaxDepth > 0 && depth >= w.MaxDepth {
+			return errMIMETooDeep
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// Raw parts keep Content-Transfer-Encoding, which is decoded below.
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = w.walk(part.Header, part, depth+1, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	p := &mimePart{
+		Header:    header,
+		MediaType: mediaType,
+		Params:    params,
+		Body:      decodeTransfer(header.Get("Content-Transfer-Encoding"), body),
+	}
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		p.Disposition = disposition
+		p.Filename = dparams["filename"]
+	}
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	p.Filename = decodeFilename(p.Filename)
+	return fn(p)
+}
+
+// Decode a Content-Transfer-Encoding, passing unknown encodings through.
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Decode RFC 2047 encoded words, which many clients use in filenames even though
+// RFC 2231 (already decoded by mime.ParseMediaType) is the standard, and drop any
+// directory so the name is safe to use.
+func decodeFilename(name string) string {
+	name = stripControl(decodeHeader(name))
+	name = path.Base(strings.Replace(name, `\`, "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// Decode RFC 2047 encoded words in a header value, leaving it as is if they
+// can't be decoded.
+func decodeHeader(value string) string {
+	dec := &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		text, ok := decodeCharset(charset, b)
+		if !ok {
+			return nil, fmt.Errorf("smtpd: unknown charset %q", charset)
+		}
+		return strings.NewReader(text), nil
+	}}
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// Remove control characters such as CR and LF, which a decoded value could use
+// to inject header lines.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Code points of windows-1252 bytes 0x80-0x9F, which ISO-8859-1 leaves to
+// control characters. Unassigned bytes map to themselves.
+var windows1252 = [32]rune{
+	0x20ac, 0x81, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x8d, 0x017d, 0x8f,
+	0x90, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x9d, 0x017e, 0x0178,
+}
+
+// Characters of ISO-8859-15 that differ from ISO-8859-1.
+var iso885915 = map[byte]rune{
+	0xa4: 0x20ac, 0xa6: 0x0160, 0xa8: 0x0161, 0xb4: 0x017d,
+	0xb8: 0x017e, 0xbc: 0x0152, 0xbd: 0x0153, 0xbe: 0x0178,
+}
+
+// Decode text in charset to UTF-8, reporting false for charsets that aren't
+// known. Only UTF-8, US-ASCII and the common Western European charsets are.
+func decodeCharset(charset string, b []byte) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(b), true
+	case "iso-8859-1", "latin1", "iso_8859-1", "l1":
+		return latin1(b, nil, false), true
+	case "windows-1252", "cp1252":
+		return latin1(b, nil, true), true
+	case "iso-8859-15", "latin-9", "iso_8859-15":
+		return latin1(b, iso885915, false), true
+	}
+	return "", false
+}
+
+// Decode an ISO-8859-1 based charset, with the given replacements.
+func latin1(b []byte, replace map[byte]rune, cp1252 bool) string {
+	var sb strings.Builder
+	sb.Grow(len(b))
+	for _, c := range b {
+		r := rune(c)
+		if cp1252 && c >= 0x80 && c < 0xa0 {
+			r = windows1252[c-0x80]
+		} else if rr, ok := replace[c]; ok {
+			r = rr
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
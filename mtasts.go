@@ -0,0 +1,134 @@
+package smtpd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MTA-STS policy modes (RFC 8461 section 3.2).
+const (
+	MTASTSEnforce = "enforce"
+	MTASTSTesting = "testing"
+	MTASTSNone    = "none"
+)
+
+// MTASTSPolicy is the MTA-STS policy of a domain.
+type MTASTSPolicy struct {
+	Mode   string        // MTASTSEnforce, MTASTSTesting or MTASTSNone
+	MX     []string      // MX host patterns, such as "mx.example.com" or "*.example.net"
+	MaxAge time.Duration // How long senders cache the policy, defaults to a week
+}
+
+// String returns the policy file.
+func (p *MTASTSPolicy) String() string {
+	maxAge := p.MaxAge
+	if maxAge == 0 {
+		maxAge = 7 * 24 * time.Hour
+	}
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	fmt.Fprintf(&b, "mode: %s\r\n", p.Mode)
+	for _, mx := range p.MX {
+		fmt.Fprintf(&b, "mx: %s\r\n", mx)
+	}
+	fmt.Fprintf(&b, "max_age: %d\r\n", int64(maxAge/time.Second))
+	return b.String()
+}
+
+// ID returns an id for the policy that changes whenever the policy does.
+func (p *MTASTSPolicy) ID() string {
+	sum := sha256.Sum256([]byte(p.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// TXTRecord returns the value of the _mta-sts TXT record announcing the policy.
+func (p *MTASTSPolicy) TXTRecord() string {
+	return "v=STSv1; id=" + p.ID() + ";"
+}
+
+// MTASTS serves the MTA-STS policies (RFC 8461) of several domains at
+// https://mta-sts.<domain>/.well-known/mta-sts.txt. It must be served over
+// HTTPS with a certificate valid for every mta-sts.<domain> name.
+type MTASTS struct {
+	Policies map[string]*MTASTSPolicy // By domain
+}
+
+// ServeHTTP implements http.Handler.
+func (m *MTASTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/.well-known/mta-sts.txt" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if !strings.HasPrefix(host, "mta-sts.") {
+		http.NotFound(w, r)
+		return
+	}
+	policy, ok := m.Policies[strings.TrimPrefix(host, "mta-sts.")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(policy.String()))
+}
+
+// CheckTLS reports an error if the certificates of config don't cover every
+// MX host in the policies, which would make senders enforcing them fail.
+func (m *MTASTS) CheckTLS(config *tls.Config) error {
+	if config == nil {
+		return fmt.Errorf("smtpd: MTA-STS policies need TLS")
+	}
+	for domain, policy := range m.Policies {
+		for _, mx := range policy.MX {
+			// A wildcard matches a single label, try one.
+			name := mx
+			if strings.HasPrefix(name, "*.") {
+				name = "mx" + name[1:]
+			}
+			if !certificateCovers(config, name) {
+				return fmt.Errorf("smtpd: no certificate for MTA-STS host %s of %s", mx, domain)
+			}
+		}
+	}
+	return nil
+}
+
+// Reports if config has a certificate valid for name.
+func certificateCovers(config *tls.Config, name string) bool {
+	certs := config.Certificates
+	if config.GetCertificate != nil {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err == nil && cert != nil {
+			certs = append([]tls.Certificate{*cert}, certs...)
+		}
+	}
+	for _, cert := range certs {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf != nil && leaf.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMTASTS(t *testing.T) {
+	policy := &MTASTSPolicy{Mode: MTASTSEnforce, MX: []string{"mx.example.com", "*.example.net"}, MaxAge: 24 * time.Hour}
+	m := &MTASTS{Policies: map[string]*MTASTSPolicy{"example.com": policy}}
+
+	want := "version: STSv1\r\nmode: enforce\r\nmx: mx.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n"
+	tests := []struct {
+		host string
+		path string
+		code int
+	}{
+		{"mta-sts.example.com", "/.well-known/mta-sts.txt", 200},
+		{"MTA-STS.Example.com:443", "/.well-known/mta-sts.txt", 200},
+		{"mta-sts.example.org", "/.well-known/mta-sts.txt", 404},
+		{"example.com", "/.well-known/mta-sts.txt", 404},
+		{"mta-sts.example.com", "/", 404},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "https://"+tt.host+tt.path, nil)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s%s: status %d, want %d", tt.host, tt.path, rec.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && (rec.Body.String() != want || rec.Header().Get("Content-Type") != "text/plain") {
+			t.Errorf("%s%s: %q %q", tt.host, tt.path, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	}
+
+	// The id changes with the policy.
+	id := policy.ID()
+	if !strings.HasPrefix(policy.TXTRecord(), "v=STSv1; id="+id) || len(id) > 32 {
+		t.Errorf("TXT record %q", policy.TXTRecord())
+	}
+	policy.Mode = MTASTSTesting
+	if policy.ID() == id {
+		t.Error("Policy id didn't change")
+	}
+}
+
+func TestMTASTSCheckTLS(t *testing.T) {
+	m := &MTASTS{Policies: map[string]*MTASTSPolicy{
+		"example.com": {Mode: MTASTSEnforce, MX: []string{"mx.example.com"}},
+	}}
+	config := &tls.Config{Certificates: []tls.Certificate{clientCertificate(t, "mx.example.com")}}
+	if err := m.CheckTLS(config); err != nil {
+		t.Errorf("CheckTLS: %v", err)
+	}
+	m.Policies["example.org"] = &MTASTSPolicy{Mode: MTASTSEnforce, MX: []string{"*.example.org"}}
+	if err := m.CheckTLS(config); err == nil {
+		t.Error("CheckTLS succeeded for a host without a certificate")
+	}
+	if err := m.CheckTLS(nil); err == nil {
+		t.Error("CheckTLS succeeded without TLS")
+	}
+}
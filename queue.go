@@ -0,0 +1,582 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deliverer delivers a queued message to its recipients.
+// Returning an *Error with a 5xx code fails the message permanently,
+// a *PartialError fails some recipients permanently and any other error is
+// retried later. Recipients removed from env.To are not retried, so a
+// Deliverer can drop the ones it already delivered to.
+type Deliverer interface {
+	Deliver(env *Envelope, msg io.Reader) error
+}
+
+// DelivererFunc adapts a function to the Deliverer interface.
+type DelivererFunc func(env *Envelope, msg io.Reader) error
+
+// Deliver calls f(env, msg).
+func (f DelivererFunc) Deliver(env *Envelope, msg io.Reader) error {
+	return f(env, msg)
+}
+
+// PartialError is returned by a Deliverer when some recipients failed
+// permanently while the ones left in env.To are to be retried. The failed
+// recipients are passed to HandlerFailed at once instead of being retried
+// until MaxAge.
+type PartialError struct {
+	Err       error    // Temporary error of the recipients left in env.To
+	Failed    []string // Recipients that failed permanently, removed from env.To
+	FailedErr error    // Permanent error of the failed recipients
+}
+
+func (err *PartialError) Error() string {
+	return err.Err.Error()
+}
+
+// HandlerFailed function called when a queued message is given up on,
+// either after a permanent error or once it is older than the queue's MaxAge.
+type HandlerFailed func(env *Envelope, msg io.Reader, err error)
+
+// ErrQueueClosed is returned when enqueuing to a closed queue.
+var ErrQueueClosed = errors.New("smtpd: queue closed")
+
+// ErrQueueNotStarted is returned when enqueuing to a queue that wasn't started,
+// as nothing would deliver the message.
+var ErrQueueNotStarted = errors.New("smtpd: queue not started")
+
+// Queue is a persistent message queue. Messages are written to Dir and synced
+// to disk before they are acknowledged, then delivered by a pool of workers
+// with exponential backoff. Messages left in Dir by a crash or restart are
+// picked up again by Start.
+type Queue struct {
+	Dir           string // Spool directory, one .env (envelope) and one .msg (message) file per message
+	Deliverer     Deliverer
+	HandlerFailed HandlerFailed
+	Workers       int           // Number of concurrent deliveries, defaults to 4
+	MinRetry      time.Duration // Delay before the first retry, doubled for every attempt, defaults to 5 minutes
+	MaxRetry      time.Duration // Maximum delay between retries, defaults to 1 hour
+	MaxAge        time.Duration // Messages are given up after this long, defaults to 5 days
+	ErrorLog      *log.Logger   // Spool errors, such as corrupt envelopes, defaults to the standard logger
+
+	mu       sync.Mutex
+	schedule map[string]time.Time // Next attempt of every message waiting for delivery
+	wake     chan struct{}
+	work     chan string
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	running  bool
+	closed   bool
+}
+
+// Queue state saved with every message.
+type queueRecord struct {
+	ID          string
+	RemoteAddr  string
+	Helo        string
+	From        string
+	To          []string
+	ORCPT       map[string]string `json:",omitempty"`
+	Auth        string            `json:",omitempty"`
+	RequireTLS  bool              `json:",omitempty"`
+	TLSOptional bool              `json:",omitempty"`
+	Ret         string            `json:",omitempty"`
+	EnvID       string            `json:",omitempty"`
+	Notify      map[string]string `json:",omitempty"`
+	Received    time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// queueAddr is the remote address of a message loaded from the spool.
+type queueAddr string
+
+func (a queueAddr) Network() string { return "queue" }
+func (a queueAddr) String() string  { return string(a) }
+
+// Start recovers any messages left in the spool directory and starts the delivery workers.
+func (q *Queue) Start() error {
+	err := os.MkdirAll(q.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if q.Deliverer == nil {
+		return errors.New("smtpd: queue has no Deliverer")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running || q.closed {
+		return errors.New("smtpd: queue already started")
+	}
+	q.init()
+
+	// Recover the spool. The .env file is written last, so messages without one
+	// were never acknowledged and temporary files are left over from a crash.
+	names, err := filepath.Glob(filepath.Join(q.Dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		base := filepath.Base(name)
+		switch {
+		case strings.HasPrefix(base, "tmp-"):
+			os.Remove(name)
+		case strings.HasSuffix(base, ".msg"):
+			if _, err := os.Stat(strings.TrimSuffix(name, ".msg") + ".env"); os.IsNotExist(err) {
+				os.Remove(name)
+			}
+		case strings.HasSuffix(base, ".env"):
+			id := strings.TrimSuffix(base, ".env")
+			rec, err := q.load(id)
+			if err != nil {
+				// One bad envelope must not keep the rest of the spool from being delivered.
+				q.quarantine(id, err)
+				continue
+			}
+			q.schedule[rec.ID] = rec.NextAttempt
+		}
+	}
+
+	workers := q.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	q.running = true
+	q.wg.Add(workers + 1)
+	go q.scheduler()
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return nil
+}
+
+// Close stops the workers, waiting for deliveries in progress to finish.
+// Queued messages stay in the spool until the queue is started again.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	running := q.running
+	q.mu.Unlock()
+
+	if running {
+		close(q.quit)
+		q.wg.Wait()
+	}
+	return nil
+}
+
+// Enqueue writes the message to the spool and schedules it for immediate delivery.
+// The message is on disk when Enqueue returns without error. The queue must
+// have been started.
+func (q *Queue) Enqueue(env *Envelope, msg io.Reader) (id string, err error) {
+	q.mu.Lock()
+	closed, running := q.closed, q.running
+	q.mu.Unlock()
+	if closed {
+		return "", ErrQueueClosed
+	}
+	if !running {
+		return "", ErrQueueNotStarted
+	}
+
+	id, err = newQueueID()
+	if err != nil {
+		return
+	}
+
+	received := env.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+	rec := &queueRecord{
+		ID:          id,
+		Helo:        env.Helo,
+		From:        env.From,
+		To:          env.To,
+		ORCPT:       env.ORCPT,
+		Auth:        env.Auth,
+		RequireTLS:  env.RequireTLS,
+		TLSOptional: env.TLSOptional,
+		Ret:         env.Ret,
+		EnvID:       env.EnvID,
+		Notify:      env.Notify,
+		Received:    received,
+		NextAttempt: received,
+	}
+	if env.RemoteAddr != nil {
+		rec.RemoteAddr = env.RemoteAddr.String()
+	}
+
+	err = q.writeFile(id+".msg", func(w io.Writer) error {
+		_, err := io.Copy(w, msg)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The envelope commits the message.
+	err = q.save(rec)
+	if err != nil {
+		os.Remove(q.path(id + ".msg"))
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.init()
+	q.schedule[id] = rec.NextAttempt
+	q.mu.Unlock()
+	q.notify()
+	return id, nil
+}
+
+// Flush schedules every queued message for immediate delivery.
+func (q *Queue) Flush() {
+	q.mu.Lock()
+	q.init()
+	now := time.Now()
+	for id := range q.schedule {
+		q.schedule[id] = now
+	}
+	q.mu.Unlock()
+	q.notify()
+}
+
+// FlushDomain schedules the queued messages with a recipient at domain, or
+// also at its subdomains, for immediate delivery and returns their number.
+// Messages being delivered aren't counted.
+func (q *Queue) FlushDomain(domain string, subdomains bool) int {
+	domain = strings.ToLower(domain)
+	q.mu.Lock()
+	q.init()
+	ids := make([]string, 0, len(q.schedule))
+	for id := range q.schedule {
+		ids = append(ids, id)
+	}
+	q.mu.Unlock()
+
+	var due []string
+	for _, id := range ids {
+		rec, err := q.load(id)
+		if err != nil {
+			continue
+		}
+		for _, to := range rec.To {
+			d := strings.ToLower(to[strings.LastIndex(to, "@")+1:])
+			if d == domain || subdomains && strings.HasSuffix(d, "."+domain) {
+				due = append(due, id)
+				break
+			}
+		}
+	}
+
+	n := 0
+	q.mu.Lock()
+	now := time.Now()
+	for _, id := range due {
+		// Skip messages handed to a worker meanwhile.
+		if _, ok := q.schedule[id]; ok {
+			q.schedule[id] = now
+			n++
+		}
+	}
+	q.mu.Unlock()
+	q.notify()
+	return n
+}
+
+// Len returns the number of messages waiting for delivery.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.schedule)
+}
+
+func (q *Queue) init() {
+	if q.schedule == nil {
+		q.schedule = make(map[string]time.Time)
+		q.wake = make(chan struct{}, 1)
+		q.work = make(chan string)
+		q.quit = make(chan struct{})
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hand due messages to the workers, sleeping until the next one is due.
+func (q *Queue) scheduler() {
+	defer q.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		var due string
+		next := now.Add(time.Hour)
+		for id, at := range q.schedule {
+			if !at.After(now) {
+				due = id
+				break
+			}
+			if at.Before(next) {
+				next = at
+			}
+		}
+		if due != "" {
+			delete(q.schedule, due)
+		}
+		q.mu.Unlock()
+
+		if due != "" {
+			select {
+			case q.work <- due:
+			case <-q.quit:
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case id := <-q.work:
+			q.deliver(id)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// Attempt delivery of a single message, rescheduling it on temporary failure.
+func (q *Queue) deliver(id string) {
+	rec, err := q.load(id)
+	if err != nil {
+		// Without its envelope the message can't be delivered.
+		q.quarantine(id, err)
+		return
+	}
+	f, err := os.Open(q.path(id + ".msg"))
+	if err != nil {
+		q.quarantine(id, err)
+		return
+	}
+	env := rec.envelope()
+	err = q.Deliverer.Deliver(env, f)
+	f.Close()
+
+	if partial, ok := err.(*PartialError); ok {
+		failed := *env
+		failed.To = partial.Failed
+		q.giveUp(id, &failed, partial.FailedErr)
+		err = partial.Err
+	}
+
+	if err == nil {
+		q.remove(id)
+		return
+	}
+
+	rec.To = env.To
+	rec.Attempts++
+	rec.LastError = err.Error()
+	smtpErr, ok := err.(*Error)
+	permanent := ok && !smtpErr.Temporary()
+	maxAge := q.MaxAge
+	if maxAge == 0 {
+		maxAge = 5 * 24 * time.Hour
+	}
+
+	if permanent || time.Since(rec.Received) > maxAge {
+		q.giveUp(id, env, err)
+		q.remove(id)
+		return
+	}
+
+	// If saving fails the old record stays on disk, which only means
+	// an earlier retry after a restart.
+	rec.NextAttempt = time.Now().Add(q.backoff(rec.Attempts))
+	q.save(rec)
+
+	q.mu.Lock()
+	q.schedule[id] = rec.NextAttempt
+	q.mu.Unlock()
+	q.notify()
+}
+
+// Pass the recipients of env that won't be retried to HandlerFailed.
+func (q *Queue) giveUp(id string, env *Envelope, err error) {
+	if q.HandlerFailed == nil || len(env.To) == 0 {
+		return
+	}
+	f, openErr := os.Open(q.path(id + ".msg"))
+	if openErr == nil {
+		q.HandlerFailed(env, f, err)
+		f.Close()
+	}
+}
+
+// Delay before the next attempt, doubling with every attempt.
+func (q *Queue) backoff(attempts int) time.Duration {
+	min, max := q.MinRetry, q.MaxRetry
+	if min == 0 {
+		min = 5 * time.Minute
+	}
+	if max == 0 {
+		max = time.Hour
+	}
+	delay := min
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (q *Queue) load(id string) (*queueRecord, error) {
+	data, err := ioutil.ReadFile(q.path(id + ".env"))
+	if err != nil {
+		return nil, err
+	}
+	rec := &queueRecord{}
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, fmt.Errorf("smtpd: corrupt queue envelope %s: %v", id, err)
+	}
+	return rec, nil
+}
+
+func (q *Queue) save(rec *queueRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return q.writeFile(rec.ID+".env", func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Move a message that can't be delivered out of the way, keeping it for
+// inspection as .env.corrupt and .msg.corrupt.
+func (q *Queue) quarantine(id string, err error) {
+	logf(q.ErrorLog, "smtpd: queue: quarantined message %s: %v", id, err)
+	os.Rename(q.path(id+".env"), q.path(id+".env.corrupt"))
+	os.Rename(q.path(id+".msg"), q.path(id+".msg.corrupt"))
+}
+
+// Remove a message, envelope first so a crash never leaves a message without its body.
+func (q *Queue) remove(id string) {
+	os.Remove(q.path(id + ".env"))
+	os.Remove(q.path(id + ".msg"))
+}
+
+// Write a spool file durably: write to a temporary file, sync it, rename it into
+// place and sync the directory so the rename survives a crash.
+func (q *Queue) writeFile(name string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(q.Dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path(name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	dir, err := os.Open(q.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dir.Sync() // Not supported on every platform.
+	return nil
+}
+
+func (q *Queue) path(name string) string {
+	return filepath.Join(q.Dir, name)
+}
+
+func (rec *queueRecord) envelope() *Envelope {
+	env := &Envelope{
+		ID:          rec.ID,
+		Helo:        rec.Helo,
+		From:        rec.From,
+		To:          rec.To,
+		ORCPT:       rec.ORCPT,
+		Auth:        rec.Auth,
+		RequireTLS:  rec.RequireTLS,
+		TLSOptional: rec.TLSOptional,
+		Ret:         rec.Ret,
+		EnvID:       rec.EnvID,
+		Notify:      rec.Notify,
+		Received:    rec.Received,
+	}
+	if rec.RemoteAddr != "" {
+		env.RemoteAddr = queueAddr(rec.RemoteAddr)
+	}
+	return env
+}
+
+// Queue IDs sort by the time they were created.
+func newQueueID() (string, error) {
+	b := make([]byte, 5)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%012X%s", time.Now().UnixNano()/int64(time.Millisecond), strings.ToUpper(hex.EncodeToString(b))), nil
+}
@@ -0,0 +1,295 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type delivery struct {
+	env *Envelope
+	msg string
+}
+
+func tempQueueDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Deliverer that fails the first failures attempts and reports every delivered message.
+func recordingDeliverer(failures int, delivered chan delivery) Deliverer {
+	return DelivererFunc(func(env *Envelope, msg io.Reader) error {
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		b, err := ioutil.ReadAll(msg)
+		if err != nil {
+			return err
+		}
+		delivered <- delivery{env, string(b)}
+		return nil
+	})
+}
+
+func waitDelivery(t *testing.T, delivered chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-delivered:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message was not delivered")
+	}
+	return delivery{}
+}
+
+// Start q with a Deliverer that always fails temporarily, so queued messages
+// stay in the spool.
+func startHeldQueue(t *testing.T, q *Queue) {
+	t.Helper()
+	q.Deliverer = DelivererFunc(func(env *Envelope, msg io.Reader) error {
+		return errors.New("held")
+	})
+	q.MinRetry = time.Hour
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Wait until n messages are scheduled again after their delivery attempt.
+func waitQueued(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Queue contains %d messages, want %d", q.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Number of messages in the spool directory.
+func spooled(t *testing.T, dir string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	delivered := make(chan delivery, 1)
+	q := &Queue{Dir: dir, Deliverer: recordingDeliverer(2, delivered), MinRetry: 10 * time.Millisecond}
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	env := &Envelope{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, From: "sender@example.com", To: []string{"recipient@example.com"}}
+	id, err := q.Enqueue(env, strings.NewReader("Subject: test\r\n\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := waitDelivery(t, delivered)
+	if d.env.ID != id || d.env.From != env.From || d.env.To[0] != env.To[0] || d.env.RemoteAddr.String() != "192.0.2.1:25" {
+		t.Errorf("Delivered envelope %+v, want %+v", d.env, env)
+	}
+	if d.msg != "Subject: test\r\n\r\nBody\r\n" {
+		t.Errorf("Delivered message %q", d.msg)
+	}
+
+	// Delivered messages are removed from the spool.
+	time.Sleep(10 * time.Millisecond)
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("Spool contains %v after delivery", names)
+	}
+}
+
+func TestQueueRecovery(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	// A queue that wasn't started doesn't accept messages.
+	q := &Queue{Dir: dir}
+	_, err := q.Enqueue(&Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}}, strings.NewReader("Body\r\n"))
+	if err != ErrQueueNotStarted {
+		t.Errorf("Enqueue before Start returned %v, want ErrQueueNotStarted", err)
+	}
+
+	// Messages queued before a crash are delivered after a restart.
+	startHeldQueue(t, q)
+	_, err = q.Enqueue(&Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}}, strings.NewReader("Body\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, q, 1)
+	q.Close()
+
+	// Incomplete messages are cleaned up.
+	ioutil.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ORPHAN.msg"), []byte("partial"), 0600)
+
+	// A corrupt envelope is quarantined instead of failing the whole spool.
+	ioutil.WriteFile(filepath.Join(dir, "BAD.env"), []byte("{"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "BAD.msg"), []byte("Body\r\n"), 0600)
+
+	delivered := make(chan delivery, 1)
+	q = &Queue{Dir: dir, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	if q.Start() == nil {
+		t.Fatal("Start without a Deliverer succeeded")
+	}
+	q.Deliverer = recordingDeliverer(0, delivered)
+	err = q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.Flush()
+
+	if d := waitDelivery(t, delivered); d.msg != "Body\r\n" {
+		t.Errorf("Delivered message %q", d.msg)
+	}
+	for _, name := range []string{"tmp-123", "ORPHAN.msg", "BAD.env", "BAD.msg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for _, name := range []string{"BAD.env.corrupt", "BAD.msg.corrupt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was not quarantined: %v", name, err)
+		}
+	}
+}
+
+func TestQueueFailed(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	failed := make(chan error, 2)
+	q := &Queue{
+		Dir: dir,
+		Deliverer: DelivererFunc(func(env *Envelope, msg io.Reader) error {
+			if env.To[0] == "unknown@example.com" {
+				return &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"}
+			}
+			return errors.New("connection refused")
+		}),
+		HandlerFailed: func(env *Envelope, msg io.Reader, err error) {
+			failed <- err
+		},
+		MaxAge: time.Millisecond,
+	}
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Permanent errors and expired messages are given up on.
+	q.Enqueue(&Envelope{To: []string{"unknown@example.com"}}, strings.NewReader("Body\r\n"))
+	q.Enqueue(&Envelope{To: []string{"recipient@example.com"}, Received: time.Now().Add(-time.Hour)}, strings.NewReader("Body\r\n"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-failed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("HandlerFailed was not called")
+		}
+	}
+}
+
+func TestQueuePartialFailure(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	failed := make(chan []string, 1)
+	delivered := make(chan delivery, 1)
+	retry := recordingDeliverer(0, delivered)
+	q := &Queue{
+		Dir: dir,
+		Deliverer: DelivererFunc(func(env *Envelope, msg io.Reader) error {
+			if len(env.To) == 1 {
+				return retry.Deliver(env, msg)
+			}
+			env.To = []string{"later@example.com"}
+			return &PartialError{
+				Err:       errors.New("connection refused"),
+				Failed:    []string{"unknown@example.com"},
+				FailedErr: &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"},
+			}
+		}),
+		HandlerFailed: func(env *Envelope, msg io.Reader, err error) {
+			failed <- env.To
+		},
+		MinRetry: 10 * time.Millisecond,
+	}
+	err := q.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Permanent failures are given up on at once, the rest is retried.
+	q.Enqueue(&Envelope{To: []string{"unknown@example.com", "later@example.com"}}, strings.NewReader("Body\r\n"))
+	select {
+	case to := <-failed:
+		if len(to) != 1 || to[0] != "unknown@example.com" {
+			t.Errorf("HandlerFailed called for %v", to)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandlerFailed was not called")
+	}
+	if d := waitDelivery(t, delivered); len(d.env.To) != 1 || d.env.To[0] != "later@example.com" {
+		t.Errorf("Retried for %v", d.env.To)
+	}
+}
+
+func TestCmdDATAQueue(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	q := &Queue{Dir: dir}
+	conn := newConn(t, &Server{Queue: q})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 451)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Once started, messages are on disk before they are acknowledged.
+	startHeldQueue(t, q)
+	defer q.Close()
+	conn = newConn(t, &Server{Queue: q})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	msg := cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	if !strings.HasPrefix(msg, "2.0.0 Ok: queued as ") {
+		t.Errorf("DATA reply is %q, want queue ID", msg)
+	}
+	if n := spooled(t, dir); n != 1 {
+		t.Errorf("Spool contains %d messages, want 1", n)
+	}
+}
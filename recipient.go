@@ -0,0 +1,425 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecipientStore looks up local domains and addresses. Implementations must be safe for concurrent use.
+type RecipientStore interface {
+	// HasDomain reports if mail for the domain is accepted.
+	HasDomain(domain string) (bool, error)
+
+	// Lookup returns the addresses mail for addr is delivered to: addr itself for
+	// a mailbox, the targets of an alias, nil if there is no such address.
+	// addr is lowercase, "@domain" is the catch-all of domain.
+	Lookup(addr string) ([]string, error)
+}
+
+var (
+	errUnknownUser   = &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"}
+	errUnknownDomain = &Error{Code: 550, EnhancedCode: "5.1.2", Message: "Domain not handled here"}
+	errLookupFailed  = &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Recipient lookup failed, please try again later"}
+	errAliasLoop     = &Error{Code: 550, EnhancedCode: "5.4.6", Message: "Alias expansion loop"}
+	errAliasDepth    = &Error{Code: 550, EnhancedCode: "5.4.6", Message: "Alias expansion too deep"}
+)
+
+// RecipientPolicy validates recipients against a RecipientStore. Local parts are
+// case-insensitive and a "+tag" suffix (user+tag@example.com) is ignored when
+// looking up the mailbox. Unknown addresses fall back to the domain's catch-all.
+//
+// With ExpandAliases set, the server replaces every recipient with the mailboxes and
+// remote addresses it expands to, and keeps the address as typed as the ORCPT
+// of each of them. A target of "@domain" keeps the local part, which maps a
+// virtual domain onto another one.
+type RecipientPolicy struct {
+	Store         RecipientStore
+	Separator     string // Separates the local part from its tag, defaults to "+"
+	NoTags        bool   // Disable plus-addressing
+	ExpandAliases bool   // Expand aliases before the handler sees the recipients
+	MaxDepth      int    // Maximum nesting of aliases, defaults to 10
+}
+
+// Check looks up a recipient, returning the addresses it is delivered to.
+// Unknown recipients get 550 5.1.1, unknown domains 550 5.1.2 and store errors 451 4.3.0.
+func (p *RecipientPolicy) Check(to string) (targets []string, err error) {
+	at := strings.LastIndex(to, "@")
+	if at == -1 {
+		return nil, errUnknownUser
+	}
+	local, domain := strings.ToLower(to[:at]), strings.ToLower(to[at+1:])
+
+	ok, err := p.Store.HasDomain(domain)
+	if err != nil {
+		return nil, errLookupFailed
+	}
+	if !ok {
+		return nil, errUnknownDomain
+	}
+
+	addr := local + "@" + domain
+	targets, err = p.Store.Lookup(addr)
+	if err == nil && targets == nil {
+		if base, tag := p.splitTag(local); tag != "" {
+			// Mailboxes keep the tag so it reaches the mailbox owner.
+			key := base + "@" + domain
+			targets, err = p.Store.Lookup(key)
+			if len(targets) == 1 && targets[0] == key {
+				targets = []string{addr}
+			}
+		}
+	}
+	if err == nil && targets == nil {
+		targets, err = p.Store.Lookup("@" + domain)
+	}
+	if err != nil {
+		return nil, errLookupFailed
+	}
+	if targets == nil {
+		return nil, errUnknownUser
+	}
+	return targets, nil
+}
+
+// Expand resolves a recipient recursively to the mailboxes and remote addresses
+// mail for it is delivered to, without duplicates. Loops and aliases nested
+// deeper than MaxDepth get 550 5.4.6, unknown targets fail like Check.
+func (p *RecipientPolicy) Expand(to string) ([]string, error) {
+	var out []string
+	err := p.expand(to, 0, make(map[string]bool), make(map[string]bool), &out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *RecipientPolicy) expand(addr string, depth int, path, seen map[string]bool, out *[]string) error {
+	key := strings.ToLower(addr)
+	if path[key] {
+		return errAliasLoop
+	}
+	maxDepth := p.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = 10
+	}
+	if depth > maxDepth {
+		return errAliasDepth
+	}
+
+	targets, err := p.Check(addr)
+	if err == errUnknownDomain && depth > 0 {
+		// Not ours, delivered remotely.
+		targets, err = []string{addr}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	path[key] = true
+	defer delete(path, key)
+	for _, target := range targets {
+		if strings.HasPrefix(target, "@") {
+			target = addr[:strings.LastIndex(addr, "@")] + target
+		}
+		// A mailbox or remote address resolves to itself.
+		if strings.EqualFold(target, addr) {
+			if !seen[strings.ToLower(target)] {
+				seen[strings.ToLower(target)] = true
+				*out = append(*out, target)
+			}
+			continue
+		}
+		err = p.expand(target, depth+1, path, seen, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split user+tag into user and tag.
+func (p *RecipientPolicy) splitTag(local string) (base, tag string) {
+	if p.NoTags {
+		return local, ""
+	}
+	sep := p.Separator
+	if sep == "" {
+		sep = "+"
+	}
+	i := strings.Index(local, sep)
+	if i <= 0 {
+		return local, ""
+	}
+	return local[:i], local[i+len(sep):]
+}
+
+// MemoryRecipientStore is a RecipientStore kept in memory.
+type MemoryRecipientStore struct {
+	mu      sync.RWMutex
+	domains map[string]bool
+	addrs   map[string][]string
+}
+
+// NewMemoryRecipientStore creates a store accepting mail for the given domains.
+func NewMemoryRecipientStore(domains ...string) *MemoryRecipientStore {
+	m := &MemoryRecipientStore{domains: make(map[string]bool), addrs: make(map[string][]string)}
+	for _, d := range domains {
+		m.domains[strings.ToLower(d)] = true
+	}
+	return m
+}
+
+// AddDomain accepts mail for domain.
+func (m *MemoryRecipientStore) AddDomain(domain string) {
+	m.mu.Lock()
+	m.domains[strings.ToLower(domain)] = true
+	m.mu.Unlock()
+}
+
+// AddMailbox adds a mailbox, adding its domain if needed.
+func (m *MemoryRecipientStore) AddMailbox(addr string) {
+	addr = strings.ToLower(addr)
+	m.AddAlias(addr, addr)
+}
+
+// AddAlias delivers mail for addr to targets, adding its domain if needed.
+// An addr of "@domain" is the catch-all of domain.
+func (m *MemoryRecipientStore) AddAlias(addr string, targets ...string) {
+	addr = strings.ToLower(addr)
+	m.mu.Lock()
+	m.domains[addr[strings.LastIndex(addr, "@")+1:]] = true
+	m.addrs[addr] = targets
+	m.mu.Unlock()
+}
+
+// HasDomain implements RecipientStore.
+func (m *MemoryRecipientStore) HasDomain(domain string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.domains[domain], nil
+}
+
+// Lookup implements RecipientStore.
+func (m *MemoryRecipientStore) Lookup(addr string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.addrs[addr], nil
+}
+
+// FileRecipientStore is a RecipientStore read from a file in the style of aliases(5):
+//
+//	# Comment
+//	user@example.com:
+//	postmaster@example.com: user@example.com, admin@example.org
+//	@example.net: catchall@example.com
+//
+// An address without targets is a mailbox. Lines starting with whitespace continue
+// the previous entry. Every domain used on the left is accepted. The file is
+// reloaded when it changes, checked at most once per ReloadInterval.
+type FileRecipientStore struct {
+	Path           string
+	ReloadInterval time.Duration // Defaults to 10 seconds
+
+	mu        sync.Mutex
+	store     *MemoryRecipientStore
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFileRecipientStore loads the recipients from path.
+func NewFileRecipientStore(path string) (*FileRecipientStore, error) {
+	f := &FileRecipientStore{Path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again. On error the previous contents are kept.
+func (f *FileRecipientStore) Reload() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	store, err := parseRecipientFile(f.Path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.store = store
+	f.modTime = info.ModTime()
+	f.lastCheck = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// HasDomain implements RecipientStore.
+func (f *FileRecipientStore) HasDomain(domain string) (bool, error) {
+	return f.current().HasDomain(domain)
+}
+
+// Lookup implements RecipientStore.
+func (f *FileRecipientStore) Lookup(addr string) ([]string, error) {
+	return f.current().Lookup(addr)
+}
+
+// Return the store, reloading the file first if it changed.
+func (f *FileRecipientStore) current() *MemoryRecipientStore {
+	interval := f.ReloadInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	f.mu.Lock()
+	store := f.store
+	check := time.Since(f.lastCheck) >= interval
+	if check {
+		f.lastCheck = time.Now()
+	}
+	modTime := f.modTime
+	f.mu.Unlock()
+
+	if check {
+		// A broken or missing file keeps the last good contents.
+		if info, err := os.Stat(f.Path); err == nil && !info.ModTime().Equal(modTime) {
+			if f.Reload() == nil {
+				f.mu.Lock()
+				store = f.store
+				f.mu.Unlock()
+			}
+		}
+	}
+	return store
+}
+
+func parseRecipientFile(path string) (*MemoryRecipientStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Join continuation lines first.
+	var entries []string
+	var lines []int
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(entries) > 0 {
+			entries[len(entries)-1] += " " + line
+			continue
+		}
+		entries = append(entries, line)
+		lines = append(lines, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	store := NewMemoryRecipientStore()
+	for i, entry := range entries {
+		colon := strings.IndexByte(entry, ':')
+		if colon == -1 || !strings.Contains(entry[:colon], "@") {
+			return nil, fmt.Errorf("smtpd: %s:%d: invalid entry %q", path, lines[i], entry)
+		}
+		addr := strings.TrimSpace(entry[:colon])
+
+		var targets []string
+		for _, t := range strings.Split(entry[colon+1:], ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			store.AddMailbox(addr)
+		} else {
+			store.AddAlias(addr, targets...)
+		}
+	}
+	return store, nil
+}
+
+// QueryRecipientStore is a RecipientStore backed by queries to an external
+// directory such as LDAP or SQL. Results are cached for CacheTTL, including
+// unknown addresses, so a burst of mail doesn't hammer the directory.
+type QueryRecipientStore struct {
+	QueryDomain  func(domain string) (bool, error)
+	QueryAddress func(addr string) ([]string, error) // Same contract as RecipientStore.Lookup
+	CacheTTL     time.Duration                       // 0 disables caching
+
+	mu    sync.Mutex
+	cache map[string]recipientCacheEntry
+}
+
+type recipientCacheEntry struct {
+	ok      bool
+	targets []string
+	expires time.Time
+}
+
+// HasDomain implements RecipientStore.
+func (q *QueryRecipientStore) HasDomain(domain string) (bool, error) {
+	if e, ok := q.cached("domain " + domain); ok {
+		return e.ok, nil
+	}
+	ok, err := q.QueryDomain(domain)
+	if err == nil {
+		q.put("domain "+domain, recipientCacheEntry{ok: ok})
+	}
+	return ok, err
+}
+
+// Lookup implements RecipientStore.
+func (q *QueryRecipientStore) Lookup(addr string) ([]string, error) {
+	if e, ok := q.cached("addr " + addr); ok {
+		return e.targets, nil
+	}
+	targets, err := q.QueryAddress(addr)
+	if err == nil {
+		q.put("addr "+addr, recipientCacheEntry{targets: targets})
+	}
+	return targets, err
+}
+
+func (q *QueryRecipientStore) cached(key string) (recipientCacheEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return e, false
+	}
+	return e, true
+}
+
+func (q *QueryRecipientStore) put(key string, e recipientCacheEntry) {
+	if q.CacheTTL <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cache == nil {
+		q.cache = make(map[string]recipientCacheEntry)
+	}
+	// Drop expired entries now and then so the cache doesn't grow forever.
+	if len(q.cache) >= 10000 {
+		now := time.Now()
+		for k, old := range q.cache {
+			if now.After(old.expires) {
+				delete(q.cache, k)
+			}
+		}
+	}
+	e.expires = time.Now().Add(q.CacheTTL)
+	q.cache[key] = e
+}
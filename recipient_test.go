@@ -0,0 +1,241 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecipientPolicy(t *testing.T) {
+	store := NewMemoryRecipientStore("example.com", "example.net")
+	store.AddMailbox("user@example.com")
+	store.AddAlias("sales@example.com", "user@example.com", "boss@example.org")
+	store.AddAlias("@example.net", "user@example.com")
+	p := &RecipientPolicy{Store: store}
+
+	tests := []struct {
+		to      string
+		targets []string
+		code    string
+	}{
+		{"user@example.com", []string{"user@example.com"}, ""},
+		{"User@Example.COM", []string{"user@example.com"}, ""},
+		{"user+news@example.com", []string{"user+news@example.com"}, ""},
+		{"sales+web@example.com", []string{"user@example.com", "boss@example.org"}, ""},
+		{"anyone@example.net", []string{"user@example.com"}, ""},
+		{"unknown@example.com", nil, "5.1.1"},
+		{"user@example.org", nil, "5.1.2"},
+	}
+	for _, tt := range tests {
+		targets, err := p.Check(tt.to)
+		if tt.code != "" {
+			if e, ok := err.(*Error); !ok || e.EnhancedCode != tt.code {
+				t.Errorf("Check(%q) returned %v, want %s", tt.to, err, tt.code)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("Check(%q) = %v, %v, want %v", tt.to, targets, err, tt.targets)
+		}
+	}
+
+	// Tags are part of the local part without plus-addressing.
+	p.NoTags = true
+	if _, err := p.Check("user+news@example.com"); err != errUnknownUser {
+		t.Errorf("Check with NoTags returned %v, want %v", err, errUnknownUser)
+	}
+}
+
+func TestRecipientPolicyLookupError(t *testing.T) {
+	q := &QueryRecipientStore{
+		QueryDomain:  func(domain string) (bool, error) { return true, nil },
+		QueryAddress: func(addr string) ([]string, error) { return nil, errors.New("directory down") },
+	}
+	if _, err := (&RecipientPolicy{Store: q}).Check("user@example.com"); err != errLookupFailed {
+		t.Errorf("Check returned %v, want %v", err, errLookupFailed)
+	}
+}
+
+func TestQueryRecipientStoreCache(t *testing.T) {
+	queries := 0
+	q := &QueryRecipientStore{
+		QueryDomain: func(domain string) (bool, error) { return true, nil },
+		QueryAddress: func(addr string) ([]string, error) {
+			queries++
+			if addr == "user@example.com" {
+				return []string{addr}, nil
+			}
+			return nil, nil
+		},
+		CacheTTL: time.Minute,
+	}
+	for i := 0; i < 3; i++ {
+		q.Lookup("user@example.com")
+		q.Lookup("unknown@example.com")
+	}
+	if queries != 2 {
+		t.Errorf("%d queries, want 2 with caching", queries)
+	}
+}
+
+func TestFileRecipientStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recipients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aliases")
+
+	ioutil.WriteFile(path, []byte("# Mailboxes\nuser@example.com:\n\npostmaster@example.com: user@example.com,\n  admin@example.org # continued\n@example.net: user@example.com\n"), 0600)
+	f, err := NewFileRecipientStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ReloadInterval = time.Nanosecond
+	p := &RecipientPolicy{Store: f}
+
+	if targets, err := p.Check("postmaster@example.com"); err != nil || !reflect.DeepEqual(targets, []string{"user@example.com", "admin@example.org"}) {
+		t.Errorf("Check(postmaster) = %v, %v", targets, err)
+	}
+	if targets, err := p.Check("someone@example.net"); err != nil || !reflect.DeepEqual(targets, []string{"user@example.com"}) {
+		t.Errorf("Check(catch-all) = %v, %v", targets, err)
+	}
+
+	// Changes are picked up, broken files are ignored.
+	ioutil.WriteFile(path, []byte("new@example.com:\n"), 0600)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if _, err := p.Check("new@example.com"); err != nil {
+		t.Errorf("Check after reload returned %v", err)
+	}
+	ioutil.WriteFile(path, []byte("broken\n"), 0600)
+	os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if _, err := p.Check("new@example.com"); err != nil {
+		t.Errorf("Check after broken reload returned %v", err)
+	}
+}
+
+func TestCmdRCPTRecipients(t *testing.T) {
+	store := NewMemoryRecipientStore()
+	store.AddMailbox("user@example.com")
+	conn := newConn(t, &Server{Recipients: &RecipientPolicy{Store: store}})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.org>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@example.com>", 250)
+	if msg := cmdCode(t, conn, "RCPT TO:<unknown@example.com>", 550); msg != "5.1.1 User unknown" {
+		t.Errorf("Unknown user reply %q", msg)
+	}
+	if msg := cmdCode(t, conn, "RCPT TO:<user@example.org>", 550); msg != "5.1.2 Domain not handled here" {
+		t.Errorf("Unknown domain reply %q", msg)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestRecipientPolicyExpand(t *testing.T) {
+	store := NewMemoryRecipientStore("example.com", "example.net")
+	store.AddMailbox("alice@example.com")
+	store.AddMailbox("bob@example.com")
+	store.AddAlias("team@example.com", "alice@example.com", "bob@example.com")
+	store.AddAlias("all@example.com", "team@example.com", "Alice@example.com", "partner@example.org")
+	store.AddAlias("@example.net", "@example.com")
+	store.AddAlias("loop1@example.com", "loop2@example.com")
+	store.AddAlias("loop2@example.com", "loop1@example.com")
+	store.AddAlias("ghost@example.com", "nobody@example.com")
+	p := &RecipientPolicy{Store: store}
+
+	tests := []struct {
+		to      string
+		targets []string
+		err     *Error
+	}{
+		{"alice+x@example.com", []string{"alice+x@example.com"}, nil},
+		{"all@example.com", []string{"alice@example.com", "bob@example.com", "partner@example.org"}, nil},
+		{"bob@example.net", []string{"bob@example.com"}, nil},
+		{"loop1@example.com", nil, errAliasLoop},
+		{"ghost@example.com", nil, errUnknownUser},
+		{"alice@example.org", nil, errUnknownDomain},
+	}
+	for _, tt := range tests {
+		targets, err := p.Expand(tt.to)
+		if tt.err != nil {
+			if err != tt.err {
+				t.Errorf("Expand(%q) returned %v, want %v", tt.to, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("Expand(%q) = %v, %v, want %v", tt.to, targets, err, tt.targets)
+		}
+	}
+
+	p.MaxDepth = 1
+	if _, err := p.Expand("all@example.com"); err != errAliasDepth {
+		t.Errorf("Expand beyond MaxDepth returned %v, want %v", err, errAliasDepth)
+	}
+}
+
+func TestCmdRCPTExpand(t *testing.T) {
+	store := NewMemoryRecipientStore()
+	store.AddMailbox("alice@example.com")
+	store.AddMailbox("bob@example.com")
+	store.AddAlias("team@example.com", "alice@example.com", "bob@example.com")
+
+	envs := make(chan *Envelope, 1)
+	conn := newConn(t, &Server{
+		Recipients: &RecipientPolicy{Store: store, ExpandAliases: true},
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			envs <- env
+			return nil
+		},
+	})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.org>", 250)
+	cmdCode(t, conn, "RCPT TO:<team@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<alice@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	env := <-envs
+	if !reflect.DeepEqual(env.To, []string{"alice@example.com", "bob@example.com"}) {
+		t.Errorf("Handler saw recipients %v", env.To)
+	}
+	if env.ORCPT["alice@example.com"] != "team@example.com" || env.ORCPT["bob@example.com"] != "team@example.com" {
+		t.Errorf("ORCPT is %v", env.ORCPT)
+	}
+}
+
+func TestCmdRCPTExpandLimit(t *testing.T) {
+	store := NewMemoryRecipientStore()
+	var first, second []string
+	for i := 0; i < 60; i++ {
+		first = append(first, fmt.Sprintf("a%d@example.com", i))
+		second = append(second, fmt.Sprintf("b%d@example.com", i))
+	}
+	for _, m := range append(first, second...) {
+		store.AddMailbox(m)
+	}
+	store.AddAlias("first@example.com", first...)
+	store.AddAlias("second@example.com", second...)
+
+	conn := newConn(t, &Server{Recipients: &RecipientPolicy{Store: store, ExpandAliases: true}})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.org>", 250)
+	cmdCode(t, conn, "RCPT TO:<first@example.com>", 250)
+
+	// The second list doesn't fit and isn't added partly.
+	cmdCode(t, conn, "RCPT TO:<second@example.com>", 452)
+	for i := 0; i < 40; i++ {
+		cmdCode(t, conn, fmt.Sprintf("RCPT TO:<b%d@example.com>", i), 250)
+	}
+	cmdCode(t, conn, "RCPT TO:<b40@example.com>", 452)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
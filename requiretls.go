@@ -0,0 +1,35 @@
+package smtpd
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+// Remove a keyword parameter from MAIL or RCPT parameters, reporting if it was present.
+func cutParam(params string, name string) (string, bool) {
+	fields := strings.Fields(params)
+	found := false
+	kept := fields[:0]
+	for _, f := range fields {
+		if strings.EqualFold(f, name) {
+			found = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if !found {
+		return params, false
+	}
+	return strings.Join(kept, " "), true
+}
+
+// Reports if the message has "TLS-Required: No" (RFC 8689 section 5).
+func tlsRequiredNo(msg []byte) bool {
+	fields, _ := splitMessage(msg)
+	for _, f := range fields {
+		if textproto.CanonicalMIMEHeaderKey(f.Name) == "Tls-Required" && strings.EqualFold(strings.TrimSpace(f.Value), "No") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestRequireTLS(t *testing.T) {
+	var got []*Envelope
+	srv := &Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			got = append(got, env)
+			return nil
+		},
+	}
+	conn := newConn(t, srv)
+	if msg := cmdCode(t, conn, "EHLO client.example.com", 250); strings.Contains(msg, "REQUIRETLS") {
+		t.Errorf("REQUIRETLS advertised without TLS: %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> REQUIRETLS", 530)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tc := textproto.NewConn(tlsConn)
+	if msg := cmdResponse(t, tc, "EHLO client.example.com", 250); !strings.Contains(msg, "REQUIRETLS") {
+		t.Errorf("REQUIRETLS not advertised over TLS: %q", msg)
+	}
+
+	// The header is ignored when the MAIL parameter is given.
+	header := "From: sender@example.com\r\nTLS-Required: No\r\n\r\nTest message.\r\n."
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com> REQUIRETLS SIZE=100", 250)
+	cmdResponse(t, tc, "RCPT TO:<recipient@example.com>", 250)
+	cmdResponse(t, tc, "DATA", 354)
+	cmdResponse(t, tc, header, 250)
+
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com>", 250)
+	cmdResponse(t, tc, "RCPT TO:<recipient@example.com>", 250)
+	cmdResponse(t, tc, "DATA", 354)
+	cmdResponse(t, tc, header, 250)
+	cmdResponse(t, tc, "QUIT", 221)
+	tc.Close()
+
+	if len(got) != 2 {
+		t.Fatalf("Got %d messages, want 2", len(got))
+	}
+	if !got[0].RequireTLS || got[0].TLSOptional {
+		t.Errorf("With REQUIRETLS: RequireTLS %v, TLSOptional %v", got[0].RequireTLS, got[0].TLSOptional)
+	}
+	if got[1].RequireTLS || !got[1].TLSOptional {
+		t.Errorf("With TLS-Required: No: RequireTLS %v, TLSOptional %v", got[1].RequireTLS, got[1].TLSOptional)
+	}
+}
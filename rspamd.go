@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Rspamd scans messages with rspamd's HTTP /checkv2 endpoint.
+type Rspamd struct {
+	URL           string        // Defaults to "http://127.0.0.1:11333/checkv2"
+	Password      string        // Controller password, optional
+	Client        *http.Client  // Defaults to a client using Timeout
+	Timeout       time.Duration // Timeout for the whole scan, defaults to 30 seconds
+	RejectScore   float64       // Reject messages scoring at least this much, 0 disables
+	TempFailScore float64       // Tempfail messages scoring at least this much, 0 disables
+}
+
+type rspamdResponse struct {
+	Score         float64                `json:"score"`
+	RequiredScore float64                `json:"required_score"`
+	Action        string                 `json:"action"`
+	Symbols       map[string]interface{} `json:"symbols"`
+}
+
+// Scan posts the message with its envelope to rspamd and parses the verdict.
+func (rs *Rspamd) Scan(env *Envelope, msg io.Reader, size int64) (*ScanResult, error) {
+	url := rs.URL
+	if url == "" {
+		url = "http://127.0.0.1:11333/checkv2"
+	}
+	client := rs.Client
+	if client == nil {
+		timeout := rs.Timeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+
+	req, err := http.NewRequest("POST", url, msg)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+
+	// Envelope details improve rspamd's SPF, greylisting and reputation checks.
+	if env != nil {
+		if env.RemoteAddr != nil {
+			if host, _, err := net.SplitHostPort(env.RemoteAddr.String()); err == nil {
+				req.Header.Set("IP", host)
+			}
+		}
+		if env.Helo != "" {
+			req.Header.Set("Helo", env.Helo)
+		}
+		req.Header.Set("From", env.From)
+		for _, to := range env.To {
+			req.Header.Add("Rcpt", to)
+		}
+	}
+	if rs.Password != "" {
+		req.Header.Set("Password", rs.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+
+	var r rspamdResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ScanResult{
+		Score: r.Score,
+		Spam:  r.Action == "reject" || r.Action == "add header" || r.Action == "rewrite subject",
+	}
+	for name := range r.Symbols {
+		res.Symbols = append(res.Symbols, name)
+	}
+	sort.Strings(res.Symbols)
+
+	res.Header = spamHeader(res, r.RequiredScore)
+	res.Header.Set("X-Spam-Action", r.Action)
+	res.Reply = scoreReply(res.Score, rs.RejectScore, rs.TempFailScore)
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// Scanner inspects the content of a message before it is accepted.
+// msg contains the complete message after dot-decoding, size is its length in bytes.
+type Scanner interface {
+	Scan(env *Envelope, msg io.Reader, size int64) (*ScanResult, error)
+}
+
+// ScanResult is the verdict of a Scanner.
+type ScanResult struct {
+	Spam    bool
+	Score   float64
+	Symbols []string             // Rules or signatures that matched
+	Header  textproto.MIMEHeader // Headers to add to the message, replacing any the client sent
+	Reply   *Error               // Reject or tempfail the message with this reply, nil to accept
+}
+
+// Read the complete message and run the milters and scanners on it.
+// Returns the message to hand to the handler and queue.
+func (s *session) filterMessage(r io.Reader) ([]byte, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The MAIL parameter takes precedence over the header (RFC 8689 section 5).
+	s.tlsOptional = !s.requireTLS && tlsRequiredNo(msg)
+
+	if s.submission() {
+		msg, err = s.submitMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.srv.HeaderValidator != nil {
+		msg, err = s.srv.HeaderValidator.Validate(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.milters) > 0 {
+		msg, err = s.milterMessage(msg)
+		if err != nil || s.discard {
+			return msg, err
+		}
+	}
+
+	if len(s.srv.Scanners) > 0 {
+		msg, err = s.scanMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Run every scanner on the message, stopping at the first rejection.
+func (s *session) scanMessage(msg []byte) ([]byte, error) {
+	env := s.envelope()
+	for _, scanner := range s.srv.Scanners {
+		res, err := scanner.Scan(env, bytes.NewReader(msg), int64(len(msg)))
+		if err != nil {
+			if s.srv.ScanFailOpen {
+				continue
+			}
+			return nil, &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Requested action aborted: content scan failed"}
+		}
+		if res.Reply != nil {
+			return nil, res.Reply
+		}
+		if len(res.Header) > 0 {
+			msg = addHeader(msg, res.Header)
+		}
+	}
+	return msg, nil
+}
+
+// Describe the current mail transaction.
+func (s *session) envelope() *Envelope {
+	return &Envelope{
+		RemoteAddr:  s.info.RemoteAddr,
+		Conn:        s.info,
+		Helo:        s.remoteName,
+		From:        s.from,
+		To:          s.to,
+		ORCPT:       s.orcpt,
+		Auth:        s.auth,
+		TLS:         s.info.TLS,
+		RequireTLS:  s.requireTLS,
+		TLSOptional: s.tlsOptional,
+		Ret:         s.ret,
+		EnvID:       s.envID,
+		Notify:      s.notify,
+	}
+}
+
+// Prepend the headers to the message, removing any existing headers with the
+// same names so clients can't forge scan results.
+func addHeader(msg []byte, header textproto.MIMEHeader) []byte {
+	fields, body := splitMessage(msg)
+
+	kept := fields[:0]
+	for _, f := range fields {
+		if _, ok := header[textproto.CanonicalMIMEHeaderKey(f.Name)]; !ok {
+			kept = append(kept, f)
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var added []headerField
+	for _, key := range keys {
+		for _, value := range header[key] {
+			added = append(added, headerField{key, value})
+		}
+	}
+	return joinMessage(append(added, kept...), body)
+}
+
+// Check a spam score against the reject and tempfail thresholds, a threshold of
+// zero is disabled.
+func scoreReply(score float64, rejectScore float64, tempFailScore float64) *Error {
+	if rejectScore > 0 && score >= rejectScore {
+		return &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Message rejected as spam"}
+	}
+	if tempFailScore > 0 && score >= tempFailScore {
+		return &Error{Code: 451, EnhancedCode: "4.7.1", Message: "Message deferred, try again later"}
+	}
+	return nil
+}
+
+// The X-Spam-* headers added for a spam scan.
+func spamHeader(res *ScanResult, threshold float64) textproto.MIMEHeader {
+	flag, status := "NO", "No"
+	if res.Spam {
+		flag, status = "YES", "Yes"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("X-Spam-Flag", flag)
+	header.Set("X-Spam-Score", fmt.Sprintf("%.2f", res.Score))
+	header.Set("X-Spam-Status", fmt.Sprintf("%s, score=%.2f required=%.2f", status, res.Score, threshold))
+	if len(res.Symbols) > 0 {
+		// Fold the list, it easily exceeds the maximum line length.
+		header.Set("X-Spam-Symbols", strings.Join(res.Symbols, ",\r\n\t"))
+	}
+	return header
+}
@@ -0,0 +1,154 @@
+package smtpd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Start a stub spamd that answers a single request with the given Spam header and symbols.
+func startSpamd(t *testing.T, spam string, symbols string) (addr string, request chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = make(chan string, 1)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		line, _ := tp.ReadLine()
+		header, _ := tp.ReadMIMEHeader()
+		var length int
+		fmt.Sscan(header.Get("Content-Length"), &length)
+		body := make([]byte, length)
+		io.ReadFull(tp.R, body)
+		request <- line + "\n" + string(body)
+
+		fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s\r\n\r\n%s", len(symbols), spam, symbols)
+	}()
+
+	return ln.Addr().String(), request
+}
+
+func TestSpamd(t *testing.T) {
+	addr, request := startSpamd(t, "True ; 7.5 / 5.0", "BAYES_99,HTML_MESSAGE\r\n")
+	sd := &Spamd{Address: addr, RejectScore: 10, TempFailScore: 7}
+
+	msg := "Subject: test\r\n\r\nBody\r\n"
+	res, err := sd.Scan(&Envelope{}, strings.NewReader(msg), int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-request; req != "SYMBOLS SPAMC/1.5\n"+msg {
+		t.Errorf("spamd received %q", req)
+	}
+	if !res.Spam || res.Score != 7.5 {
+		t.Errorf("Scan returned spam %v score %v, want true 7.5", res.Spam, res.Score)
+	}
+	if strings.Join(res.Symbols, " ") != "BAYES_99 HTML_MESSAGE" {
+		t.Errorf("Scan returned symbols %v", res.Symbols)
+	}
+	if res.Reply == nil || res.Reply.Code != 451 {
+		t.Errorf("Scan returned reply %v, want tempfail", res.Reply)
+	}
+	if res.Header.Get("X-Spam-Flag") != "YES" {
+		t.Errorf("Scan returned header %v, want X-Spam-Flag: YES", res.Header)
+	}
+}
+
+func TestRspamd(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/checkv2" || r.Header.Get("From") != "sender@example.com" || len(r.Header["Rcpt"]) != 2 || len(body) == 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"score": 16.2, "required_score": 15, "action": "reject", "symbols": {"R_SPF_FAIL": {}, "BAYES_SPAM": {}}}`)
+	}))
+	defer ts.Close()
+
+	rs := &Rspamd{URL: ts.URL + "/checkv2", RejectScore: 15}
+	env := &Envelope{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		From:       "sender@example.com",
+		To:         []string{"one@example.com", "two@example.com"},
+	}
+	msg := "Subject: test\r\n\r\nBody\r\n"
+	res, err := rs.Scan(env, strings.NewReader(msg), int64(len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Spam || res.Score != 16.2 {
+		t.Errorf("Scan returned spam %v score %v, want true 16.2", res.Spam, res.Score)
+	}
+	if strings.Join(res.Symbols, " ") != "BAYES_SPAM R_SPF_FAIL" {
+		t.Errorf("Scan returned symbols %v", res.Symbols)
+	}
+	if res.Reply == nil || res.Reply.Code != 550 {
+		t.Errorf("Scan returned reply %v, want reject", res.Reply)
+	}
+}
+
+type stubScanner struct {
+	res *ScanResult
+	err error
+}
+
+func (sc stubScanner) Scan(env *Envelope, msg io.Reader, size int64) (*ScanResult, error) {
+	return sc.res, sc.err
+}
+
+func TestCmdDATAScanners(t *testing.T) {
+	var gotHeader textproto.MIMEHeader
+	server := &Server{
+		Handler: func(bytesRead int, remoteAddr net.Addr, from string, to []string, header textproto.MIMEHeader, body io.Reader) error {
+			gotHeader = header
+			return nil
+		},
+	}
+	send := func(code int) {
+		conn := newConn(t, server)
+		cmdCode(t, conn, "EHLO host.example.com", 250)
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+		cmdCode(t, conn, "DATA", 354)
+		cmdCode(t, conn, "X-Spam-Flag: NO\r\n"+mimeHeaders+"Test message.\r\n.", code)
+		cmdCode(t, conn, "QUIT", 221)
+		conn.Close()
+	}
+
+	// Headers are added, replacing the ones sent by the client.
+	header := textproto.MIMEHeader{}
+	header.Set("X-Spam-Flag", "YES")
+	server.Scanners = []Scanner{stubScanner{res: &ScanResult{Header: header}}}
+	send(250)
+	if v := gotHeader["X-Spam-Flag"]; len(v) != 1 || v[0] != "YES" {
+		t.Errorf("Handler received X-Spam-Flag %v, want [YES]", v)
+	}
+
+	// Rejections are sent as the reply.
+	server.Scanners = []Scanner{stubScanner{res: &ScanResult{Reply: &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Spam"}}}}
+	send(550)
+
+	// Scanner failures tempfail the message unless failing open.
+	server.Scanners = []Scanner{stubScanner{err: io.ErrUnexpectedEOF}}
+	send(451)
+	server.ScanFailOpen = true
+	send(250)
+}
@@ -1,6 +1,7 @@
 package smtpd
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -16,22 +17,45 @@ import (
 )
 
 type session struct {
-	srv    *Server
-	conn   net.Conn
-	tpconn *textproto.Conn
+	srv      *Server
+	listener *Listener // Listener the connection was accepted on, nil when using Serve
+	info     *ConnInfo
+	conn     net.Conn
+	tpconn   *textproto.Conn
 
 	remoteIP   string // Remote IP address
 	remoteHost string // Remote hostname according to reverse DNS lookup
 	remoteName string // Remote hostname as supplied with EHLO
 	tls        bool
+	auth       string // Identity the client authenticated as with AUTH
+
+	// Current mail transaction.
+	from    string
+	gotFrom bool
+	to      []string
+	orcpt   map[string]string // Original recipient of expanded addresses
+	discard bool              // A milter asked for the message to be discarded
+
+	requireTLS  bool // MAIL FROM had REQUIRETLS
+	tlsOptional bool // Message has "TLS-Required: No"
+
+	// DSN parameters (RFC 3461).
+	ret    string
+	envID  string
+	notify map[string]string // NOTIFY by recipient
+
+	milters     []*milterConn
+	discardConn bool // A milter asked at the connect or HELO stage for every message to be discarded
 }
 
 // Function called to handle connection requests.
 func (s *session) serve() {
 	defer s.conn.Close()
-	var from string
-	var gotFrom bool
-	var to []string
+	defer s.milterClose()
+
+	if !s.greet() {
+		return
+	}
 
 	// Send banner.
 	s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
@@ -53,101 +77,190 @@ loop:
 
 		switch verb {
 		case "HELO":
+			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
+			s.reset()
+
 			s.remoteName = args
+			if reply := s.milterHelo(); reply != "" {
+				s.writef("%s", reply)
+				break
+			}
 			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
-
-			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
-			from = ""
-			gotFrom = false
-			to = nil
 		case "EHLO":
-			s.remoteName = args
-			s.writef(s.makeEHLOResponse())
-
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
+
+			s.remoteName = args
+			if reply := s.milterHelo(); reply != "" {
+				s.writef("%s", reply)
+				break
+			}
+			s.writef("%s", s.makeEHLOResponse())
 		case "MAIL":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.tlsRequired() && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
+			if s.authRequired() && s.auth == "" {
+				s.writef("530 5.7.0 Authentication required")
+				break
+			}
+
+			// A new MAIL command starts a new transaction.
+			s.reset()
 
 			match := mailFromRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
-			} else {
-				// Validate the SIZE parameter if one was sent.
-				if len(match[2]) > 0 { // A parameter is present
-					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
-					if sizeMatch == nil {
-						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-					} else {
-						// Enforce the maximum message size if one is set.
-						size, err := strconv.Atoi(sizeMatch[1])
-						if err != nil { // Bad SIZE parameter
-							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
-							err = maxSizeExceeded(s.srv.MaxSize)
-							s.writef(err.Error())
-						} else { // SIZE ok
-							from = match[1]
-							gotFrom = true
-							s.writef("250 2.1.0 Ok")
-						}
-					}
-				} else { // No parameters after FROM
-					from = match[1]
-					gotFrom = true
-					s.writef("250 2.1.0 Ok")
+				break
+			}
+
+			// REQUIRETLS (RFC 8689 section 4.1) is only allowed over TLS.
+			params, requireTLS := cutParam(match[3], "REQUIRETLS")
+			if requireTLS && !s.tls {
+				s.writef("530 5.7.10 REQUIRETLS requires a TLS session")
+				break
+			}
+
+			// DSN parameters (RFC 3461 section 4).
+			params, ret, hasRet := cutValueParam(params, "RET")
+			if hasRet && !strings.EqualFold(ret, "FULL") && !strings.EqualFold(ret, "HDRS") {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid RET parameter)")
+				break
+			}
+			params, envID, hasEnvID := cutValueParam(params, "ENVID")
+			if hasEnvID {
+				var ok bool
+				envID, ok = xtextDecode(envID)
+				if !ok || envID == "" || len(envID) > 100 {
+					s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid ENVID parameter)")
+					break
+				}
+			}
+
+			// Validate the SIZE parameter if one was sent.
+			if len(match[2]) > 0 && (!(requireTLS || hasRet || hasEnvID) || params != "") { // A parameter is present
+				sizeMatch := mailSizeRE.FindStringSubmatch(params)
+				if sizeMatch == nil {
+					s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+					break
 				}
+
+				// Enforce the maximum message size if one is set.
+				size, err := strconv.Atoi(sizeMatch[1])
+				if err != nil { // Bad SIZE parameter
+					s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+					break
+				}
+				if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
+					s.writef(maxSizeExceeded(s.srv.MaxSize).Error())
+					break
+				}
+			}
+
+			// RFC 6409 section 6.1: the sender must belong to the authenticated identity.
+			if s.auth != "" && s.srv.HandlerSender != nil && !s.srv.HandlerSender(s.auth, match[1]) {
+				s.writef("553 5.7.1 Sender address not owned by authenticated user")
+				break
+			}
+
+			if reply := s.milterMail(match[1], strings.Fields(match[3])); reply != "" {
+				s.writef("%s", reply)
+				break
 			}
-			to = nil
-			// buffer.Reset()
+
+			s.from = match[1]
+			s.gotFrom = true
+			s.requireTLS = requireTLS
+			s.ret = strings.ToUpper(ret)
+			s.envID = envID
+			s.writef("250 2.1.0 Ok")
 		case "RCPT":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.tlsRequired() && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
 
-			if !gotFrom {
+			if !s.gotFrom {
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
 				break
 			}
 
 			match := rcptToRE.FindStringSubmatch(args)
-			if match == nil {
+			var notify, orcpt string
+			ok := match != nil
+			if ok {
+				notify, orcpt, ok = rcptDSNParams(match[3])
+			}
+			if !ok {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
 			} else {
 				// RFC 5321 specifies 100 minimum recipients
 				// https://tools.ietf.org/html/rfc5321#section-4.5.3.1.10
-				if len(to) == 100 {
+				// Aliases expand to several recipients, all count towards the limit.
+				if len(s.to) >= maxRecipients {
 					s.writef("452 4.5.3 Too many recipients")
 				} else {
 					accept := true
 					if s.srv.HandlerRcpt != nil {
-						accept = s.srv.HandlerRcpt(s.conn.RemoteAddr(), from, match[1])
+						accept = s.srv.HandlerRcpt(s.hookAddr(), s.from, match[1])
 					}
-					if accept {
-						to = append(to, match[1])
-						s.writef("250 2.1.5 Ok")
-					} else {
+					if !accept {
 						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
+						break
 					}
+
+					targets, err := s.recipientTargets(match[1])
+					if err != nil {
+						s.writef("%s", err.Error())
+						break
+					}
+
+					// An expansion is accepted whole or not at all.
+					if !s.recipientsFit(targets) {
+						s.writef("452 4.5.3 Too many recipients")
+						break
+					}
+
+					// Greylisting fails open so a broken store doesn't block all mail.
+					// Authenticated clients aren't spammers retrying blindly, skip them.
+					if s.srv.Greylist != nil && s.auth == "" {
+						pass, err := s.srv.Greylist.Check(s.info.RemoteAddr, s.from, match[1])
+						if err != nil {
+							s.srv.logf("smtpd: greylist: %v", err)
+						}
+						if err == nil && !pass {
+							s.writef("451 4.7.1 Greylisted, please try again later")
+							break
+						}
+					}
+
+					if reply := s.milterRcpt(match[1]); reply != "" {
+						s.writef("%s", reply)
+						break
+					}
+
+					s.addRecipients(match[1], targets)
+					s.addRecipientDSN(targets, notify, orcpt)
+					s.writef("250 2.1.5 Ok")
 				}
 			}
 		case "DATA":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.tlsRequired() && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
 
-			if !gotFrom || len(to) == 0 {
+			if !s.gotFrom || len(s.to) == 0 {
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
 				break
 			}
 
+			if reply := s.milterData(); reply != "" {
+				s.writef("%s", reply)
+				break
+			}
+
 			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
 
 			// Regardless of the limit desired, this is useful to track how much we
@@ -157,31 +270,54 @@ loop:
 			// Create Received header & write message body into buffer.
 			// buffer.Write(s.makeHeaders(to))
 
-			err = mimestream.HandleEmailFromReader(r, func(header textproto.MIMEHeader, body io.Reader) (err error) {
+			// Validation, milters, scanners, HandlerMessage and the queue need the complete message before it can be handed over.
+			var data io.Reader = r
+			var msg []byte
+			if len(s.milters) > 0 || len(s.srv.Scanners) > 0 || s.submission() || s.srv.HeaderValidator != nil || s.srv.HandlerMessage != nil || s.srv.Queue != nil {
+				msg, err = s.filterMessage(r)
+				data = bytes.NewReader(msg)
+			}
 
-				// Pass mail on to handler.
-				if s.srv.Handler != nil {
-					err = s.srv.Handler(r.BytesRead, s.conn.RemoteAddr(), from, to, header, body)
-				} else if Debug {
-					var b []byte
-					b, err = ioutil.ReadAll(body)
+			if err == nil && !s.discard {
+				err = mimestream.HandleEmailFromReader(data, func(header textproto.MIMEHeader, body io.Reader) (err error) {
 
-					fmt.Printf("\nMaxReader Read: %d with limit %d\n", r.BytesRead, s.srv.MaxSize)
-					fmt.Printf("HEADER: %v\n", header)
-					fmt.Printf("BODY: %d %q\n", len(b), b)
+					// Pass mail on to handler.
+					if s.srv.Handler != nil {
+						err = s.srv.Handler(r.BytesRead, s.hookAddr(), s.from, s.to, header, body)
+					} else if Debug {
+						var b []byte
+						b, err = ioutil.ReadAll(body)
 
-					if err != nil {
-						return err
+						fmt.Printf("\nMaxReader Read: %d with limit %d\n", r.BytesRead, s.srv.MaxSize)
+						fmt.Printf("HEADER: %v\n", header)
+						fmt.Printf("BODY: %d %q\n", len(b), b)
+
+						if err != nil {
+							return err
+						}
 					}
-				}
 
-				// Read any remaining body to trigger maxSizeExceeded if needed
-				if err == nil {
-					_, err = io.Copy(ioutil.Discard, body)
-				}
+					// Read any remaining body to trigger maxSizeExceeded if needed
+					if err == nil {
+						_, err = io.Copy(ioutil.Discard, body)
+					}
 
-				return
-			})
+					return
+				})
+			}
+
+			if err == nil && !s.discard && s.srv.HandlerMessage != nil {
+				err = s.srv.HandlerMessage(s.envelope(), bytes.NewReader(msg))
+			}
+
+			// The message must be on disk before it is acknowledged.
+			var id string
+			if err == nil && !s.discard && s.srv.Queue != nil {
+				id, err = s.srv.Queue.Enqueue(s.envelope(), bytes.NewReader(msg))
+				if err != nil {
+					err = &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Requested action aborted: local error in processing"}
+				}
+			}
 
 			if err != nil {
 				switch err.(type) {
@@ -191,11 +327,15 @@ loop:
 					}
 					break loop
 				case maxSizeExceededError:
-					s.writef(err.Error())
+					s.writef("%s", err.Error())
+					continue
+				case *Error:
+					s.writef("%s", err.Error())
+					s.reset()
 					continue
 				default:
 					// s.writef("451 4.3.0 Requested action aborted: local error in processing")
-					s.writef("451 4.3.0 Requested action aborted: " + err.Error())
+					s.writef("451 4.3.0 Requested action aborted: %s", err)
 					continue
 				}
 			}
@@ -204,33 +344,54 @@ loop:
 			// io.Copy(ioutil.Discard, r)
 
 			// Mail processing complete
-			if s.srv.HandlerSuccess != nil {
-				s.srv.HandlerSuccess(r.BytesRead, s.conn.RemoteAddr(), from, to)
+			if s.srv.HandlerSuccess != nil && !s.discard {
+				s.srv.HandlerSuccess(r.BytesRead, s.hookAddr(), s.from, s.to)
 			}
 
-			s.writef("250 2.0.0 Ok: queued")
+			if id != "" {
+				s.writef("250 2.0.0 Ok: queued as %s", id)
+			} else {
+				s.writef("250 2.0.0 Ok: queued")
+			}
 
 			// Reset for next mail.
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "QUIT":
 			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
 			break loop
 		case "RSET":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.tlsRequired() && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
 			s.writef("250 2.0.0 Ok")
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "NOOP":
 			s.writef("250 2.0.0 Ok")
-		case "HELP", "VRFY", "EXPN":
+		case "HELP":
 			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
 			s.writef("502 5.5.1 Command not implemented")
+		case "VRFY", "EXPN":
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			if verb == "VRFY" {
+				s.handleVerify(args)
+			} else {
+				s.handleExpand(args)
+			}
+		case "ETRN":
+			// Without HandlerETRN, ETRN may be a registered Command.
+			if s.srv.HandlerETRN == nil {
+				s.handleCommand(verb, args)
+				break
+			}
+			if s.tlsRequired() && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			s.handleETRN(args)
 		case "STARTTLS":
 			// Parameters are not allowed (RFC 3207 section 4).
 			if args != "" {
@@ -239,7 +400,7 @@ loop:
 			}
 
 			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.TLSConfig == nil {
+			if s.srv.TLSConfig == nil || s.listener != nil && s.listener.TLS == TLSNone {
 				s.writef("502 5.5.1 Command not implemented")
 				break
 			}
@@ -254,7 +415,7 @@ loop:
 
 			// Establish a TLS connection with the client.
 			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
-			err := tlsConn.Handshake()
+			err := s.handshake(tlsConn)
 			if err != nil {
 				s.writef("403 4.7.0 TLS handshake failed")
 				break
@@ -267,27 +428,135 @@ loop:
 
 			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
 			s.remoteName = ""
-			from = ""
-			gotFrom = false
-			to = nil
+			s.auth = ""
+			s.reset()
 		case "AUTH":
+			s.handleAuth(args)
+		default:
+			s.handleCommand(verb, args)
+		}
+	}
+}
 
-			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments")
-			// should be returned when attempting to use an unsupported authentication type.
-			// Many servers return 5.7.4 ("Security features not supported") instead.
-			// RFC 4954 specifies that AUTH is not permitted during mail transactions.
+// A connection refused before the banner gets 421 or 554 instead of the
+// banner (RFC 5321 section 3.1), whatever code the check chose.
+func greetingReply(reply string) string {
+	if strings.HasPrefix(reply, "4") {
+		return "421" + reply[3:]
+	}
+	return "554" + reply[3:]
+}
 
-			// None of this matters for us though, we don't use standard user/pass AUTH
-			s.writef("502 5.5.1 Command not implemented")
-			break
+// Run the connection checks that happen before the banner is sent.
+// Returns false if the connection was refused.
+func (s *session) greet() bool {
+	// Implicit TLS connections complete the handshake first so handlers can inspect it.
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		if s.handshake(tlsConn) != nil {
+			return false
+		}
+	}
 
-		default:
-			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
-			s.writef("500 5.5.2 Syntax error, command unrecognized")
+	if s.srv.HandlerConnect != nil {
+		err := s.srv.HandlerConnect(s.hookAddr(), s.info.TLS)
+		if err != nil {
+			reply := "554 5.7.1 " + err.Error()
+			if smtpErr, ok := err.(*Error); ok {
+				reply = smtpErr.Error()
+			}
+			s.writef("%s", greetingReply(reply))
+			return false
+		}
+	}
+
+	// Consult the milters before sending the banner.
+	if len(s.srv.Milters) > 0 {
+		if reply := s.milterConnect(); reply != "" {
+			s.writef("%s", greetingReply(reply))
+			return false
+		}
+	}
+
+	// Legitimate clients wait for the banner, spambots often don't (RFC 5321 section 4.3.1).
+	if s.srv.GreetDelay > 0 {
+		err := s.conn.SetReadDeadline(time.Now().Add(s.srv.GreetDelay))
+		if err != nil {
+			return false
+		}
+		_, err = s.tpconn.R.Peek(1)
+		if err == nil {
+			s.writef("554 5.5.1 Protocol error: client sent data before greeting")
+			return false
+		}
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return false
+		}
+		s.conn.SetReadDeadline(time.Time{})
+	}
+
+	return true
+}
+
+// Check a recipient against the RecipientPolicy, returning the addresses it
+// expands to.
+func (s *session) recipientTargets(to string) ([]string, error) {
+	if s.srv.Recipients == nil {
+		return []string{to}, nil
+	}
+	if s.srv.Recipients.ExpandAliases {
+		return s.srv.Recipients.Expand(to)
+	}
+	_, err := s.srv.Recipients.Check(to)
+	if err != nil {
+		return nil, err
+	}
+	return []string{to}, nil
+}
+
+// Reports if the addresses a recipient expanded to fit in the recipient limit.
+func (s *session) recipientsFit(targets []string) bool {
+	n := len(s.to)
+	for i, to := range targets {
+		if indexFold(s.to, to) == -1 && indexFold(targets[:i], to) == -1 {
+			n++
+		}
+	}
+	return n <= maxRecipients
+}
+
+// Add the addresses a recipient expanded to, remembering the original recipient.
+func (s *session) addRecipients(orig string, targets []string) {
+	for _, to := range targets {
+		if indexFold(s.to, to) != -1 {
+			continue
+		}
+		s.to = append(s.to, to)
+		if to != orig {
+			if s.orcpt == nil {
+				s.orcpt = make(map[string]string)
+			}
+			s.orcpt[to] = orig
 		}
 	}
 }
 
+// Reset the current mail transaction.
+func (s *session) reset() {
+	if s.gotFrom {
+		s.milterAbort()
+	}
+	s.from = ""
+	s.gotFrom = false
+	s.to = nil
+	s.orcpt = nil
+	s.discard = s.discardConn
+	s.requireTLS = false
+	s.tlsOptional = false
+	s.ret = ""
+	s.envID = ""
+	s.notify = nil
+}
+
 // Wrapper function for writing a complete line to the socket.
 func (s *session) writef(format string, args ...interface{}) (err error) {
 	if s.srv.Timeout > 0 {
@@ -365,11 +634,30 @@ func (s *session) makeEHLOResponse() (response string) {
 	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
 	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
 
+	response += "250-DSN\r\n"
+
 	// Only list STARTTLS if TLS is configured, but not currently in use.
-	if s.srv.TLSConfig != nil && !s.tls {
+	if s.startTLSAllowed() {
 		response += "250-STARTTLS\r\n"
 	}
 
+	if mechanisms := s.authMechanisms(); len(mechanisms) > 0 {
+		response += "250-AUTH " + strings.Join(mechanisms, " ") + "\r\n"
+	}
+
+	// RFC 8689 section 4: only offered over TLS.
+	if s.tls {
+		response += "250-REQUIRETLS\r\n"
+	}
+
+	if s.srv.HandlerETRN != nil && (s.tls || !s.tlsRequired()) {
+		response += "250-ETRN\r\n"
+	}
+
+	for _, keyword := range s.commandKeywords() {
+		response += "250-" + keyword + "\r\n"
+	}
+
 	response += "250 ENHANCEDSTATUSCODES"
 	return
 }
@@ -0,0 +1,219 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/Xeoncross/smtpd/client"
+)
+
+// Route is an upstream server mail is forwarded to.
+type Route struct {
+	Host      string // "host:port" of the upstream server
+	Username  string // Authenticate with AUTH PLAIN if set, only over TLS or to localhost
+	Password  string
+	TLSPolicy client.TLSPolicy // STARTTLS policy, opportunistic by default
+	TLSConfig *tls.Config
+}
+
+// SmartHost forwards messages to upstream servers chosen by recipient domain.
+// Routes are keyed by domain ("example.com"), wildcard ("*.example.com", which
+// matches any subdomain) or "*" for the default route. Exact matches win over
+// wildcards and longer wildcards over shorter ones.
+//
+// Use Deliver as a Queue's Deliverer, or HandlerMessage to relay synchronously
+// during DATA. Either way set HandlerRcpt so recipients without a route are
+// rejected at RCPT.
+type SmartHost struct {
+	Routes   map[string]*Route
+	Hostname string        // Name sent with EHLO
+	Timeout  time.Duration // Timeout for connecting and each command, defaults to 5 minutes
+	Queue    *Queue        // Retries and bounces the recipients that failed when others were delivered to, required by HandlerMessage
+}
+
+var (
+	errNoRoute          = &Error{Code: 550, EnhancedCode: "5.1.2", Message: "No route to destination domain"}
+	errSmartHostNoQueue = &Error{Code: 451, EnhancedCode: "4.3.5", Message: "Smart host has no queue for failed recipients"}
+)
+
+// Route returns the route for the address or domain, nil if there is none.
+func (sh *SmartHost) Route(addr string) *Route {
+	domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+	if r, ok := sh.Routes[domain]; ok {
+		return r
+	}
+	for {
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+		if r, ok := sh.Routes["*."+domain]; ok {
+			return r
+		}
+	}
+	return sh.Routes["*"]
+}
+
+// HandlerRcpt accepts only recipients there is a route for.
+func (sh *SmartHost) HandlerRcpt(remoteAddr net.Addr, from string, to string) bool {
+	return sh.Route(to) != nil
+}
+
+// Deliver relays the message to the upstream of every recipient, grouping the
+// recipients that share one. Only the recipients that failed are left in
+// env.To. If all failures are temporary or all are permanent, the reply for
+// the first one is returned. Otherwise the permanent failures are removed from
+// env.To and returned in a *PartialError, so a Queue bounces them at once and
+// only retries the temporary ones.
+func (sh *SmartHost) Deliver(env *Envelope, msg io.Reader) error {
+	body, ok := msg.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(msg)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	var routes []*Route
+	byRoute := make(map[*Route][]string)
+	var temp, perm []string
+	var tempErr, permErr *Error
+	for _, to := range env.To {
+		r := sh.Route(to)
+		if r == nil {
+			perm = append(perm, to)
+			if permErr == nil {
+				permErr = errNoRoute
+			}
+			continue
+		}
+		if _, ok := byRoute[r]; !ok {
+			routes = append(routes, r)
+		}
+		byRoute[r] = append(byRoute[r], to)
+	}
+
+	for _, r := range routes {
+		c := &client.Client{
+			Hostname:  sh.Hostname,
+			TLSPolicy: r.TLSPolicy,
+			TLSConfig: r.TLSConfig,
+			Timeout:   sh.Timeout,
+		}
+		if r.Username != "" {
+			host, _, _ := net.SplitHostPort(r.Host)
+			c.Auth = smtp.PlainAuth("", r.Username, r.Password, host)
+		}
+		res := c.SendHosts([]string{r.Host}, &client.Message{From: env.From, To: byRoute[r], Body: body, ORCPT: env.ORCPT, Notify: env.Notify, Ret: env.Ret, EnvID: env.EnvID, RequireTLS: env.RequireTLS})
+
+		for _, rcpt := range res.Recipients {
+			if rcpt.Status == client.StatusDelivered {
+				continue
+			}
+			err := relayError(rcpt.Err)
+			if err.Temporary() {
+				temp = append(temp, rcpt.Address)
+				if tempErr == nil {
+					tempErr = err
+				}
+			} else {
+				perm = append(perm, rcpt.Address)
+				if permErr == nil {
+					permErr = err
+				}
+			}
+		}
+	}
+
+	switch {
+	case tempErr != nil && permErr != nil:
+		env.To = temp
+		return &PartialError{Err: tempErr, Failed: perm, FailedErr: permErr}
+	case tempErr != nil:
+		env.To = temp
+		return tempErr
+	case permErr != nil:
+		env.To = perm
+		return permErr
+	}
+	env.To = nil
+	return nil
+}
+
+// HandlerMessage relays the message during DATA. If no recipient could be
+// delivered to, the upstream's reply is passed on to the client. If only some
+// failed, the message is accepted: temporary failures are queued on Queue to
+// be retried and permanent ones are bounced at once with its HandlerFailed, so
+// the client never sends the message twice. Without a Queue every message is
+// refused, as a partial failure couldn't be reported.
+//
+// Don't also set the Server's Queue, the message would be relayed once here
+// and again by the queue. To relay after queueing, make the SmartHost the
+// queue's Deliverer instead.
+func (sh *SmartHost) HandlerMessage(env *Envelope, msg io.Reader) error {
+	if sh.Queue == nil {
+		return errSmartHostNoQueue
+	}
+	b, err := ioutil.ReadAll(msg)
+	if err != nil {
+		return err
+	}
+
+	n := len(env.To)
+	err = sh.Deliver(env, bytes.NewReader(b))
+	if err == nil {
+		return nil
+	}
+	failed := len(env.To)
+	partial, isPartial := err.(*PartialError)
+	if isPartial {
+		failed += len(partial.Failed)
+	}
+	if failed == n {
+		if isPartial {
+			return partial.Err
+		}
+		return err
+	}
+
+	if isPartial {
+		bounced := *env
+		bounced.To = partial.Failed
+		sh.bounce(&bounced, b, partial.FailedErr)
+		err = partial.Err
+	}
+	if smtpErr, ok := err.(*Error); ok && !smtpErr.Temporary() {
+		sh.bounce(env, b, err)
+		return nil
+	}
+	_, err = sh.Queue.Enqueue(env, bytes.NewReader(b))
+	return err
+}
+
+// Report recipients that failed permanently with the queue's HandlerFailed.
+func (sh *SmartHost) bounce(env *Envelope, msg []byte, err error) {
+	if sh.Queue.HandlerFailed != nil {
+		sh.Queue.HandlerFailed(env, bytes.NewReader(msg), err)
+	}
+}
+
+// Turn a client error into the reply passed on to the sender.
+func relayError(err error) *Error {
+	if e, ok := err.(*client.Error); ok {
+		reply := &Error{Code: e.Code, EnhancedCode: e.EnhancedCode, Message: e.Message}
+		if reply.EnhancedCode == "" {
+			reply.EnhancedCode = fmt.Sprintf("%d.0.0", e.Code/100)
+		}
+		return reply
+	}
+	return &Error{Code: 451, EnhancedCode: "4.4.1", Message: "Upstream server unavailable"}
+}
@@ -0,0 +1,247 @@
+package smtpd
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start an upstream server that rejects unknown@ recipients and reports the
+// recipients of every message it receives.
+func startUpstream(t *testing.T) (addr string, received chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received = make(chan []string, 10)
+	srv := &Server{
+		Hostname: "upstream.example.com",
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			return !strings.HasPrefix(to, "unknown@")
+		},
+		Handler: func(bytesRead int, remoteAddr net.Addr, from string, to []string, header textproto.MIMEHeader, body io.Reader) error {
+			ioutil.ReadAll(body)
+			received <- to
+			return nil
+		},
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String(), received
+}
+
+// Address nothing listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func TestSmartHostRoute(t *testing.T) {
+	exact, wildcard, deep, fallback := &Route{}, &Route{}, &Route{}, &Route{}
+	sh := &SmartHost{Routes: map[string]*Route{
+		"example.com":       exact,
+		"*.example.com":     wildcard,
+		"*.sub.example.com": deep,
+	}}
+
+	tests := []struct {
+		addr string
+		want *Route
+	}{
+		{"user@example.com", exact},
+		{"user@EXAMPLE.com", exact},
+		{"user@mail.example.com", wildcard},
+		{"user@a.sub.example.com", deep},
+		{"user@example.org", nil},
+	}
+	for _, tt := range tests {
+		if got := sh.Route(tt.addr); got != tt.want {
+			t.Errorf("Route(%q) = %p, want %p", tt.addr, got, tt.want)
+		}
+	}
+
+	sh.Routes["*"] = fallback
+	if got := sh.Route("user@example.org"); got != fallback {
+		t.Errorf("Route(%q) = %p, want default route", "user@example.org", got)
+	}
+}
+
+func TestSmartHostDeliver(t *testing.T) {
+	addr, received := startUpstream(t)
+	sh := &SmartHost{
+		Hostname: "relay.example.com",
+		Routes: map[string]*Route{
+			"example.com":   {Host: addr},
+			"*.example.net": {Host: closedAddr(t)},
+		},
+	}
+
+	env := &Envelope{
+		From: "sender@example.org",
+		To:   []string{"user@example.com", "unknown@example.com", "user@sub.example.net", "user@example.org"},
+	}
+	err := sh.Deliver(env, strings.NewReader("Subject: test\r\n\r\nBody\r\n"))
+
+	// The unreachable upstream is retried, the rejected and unroutable
+	// recipients fail at once.
+	partial, ok := err.(*PartialError)
+	if !ok {
+		t.Fatalf("Deliver returned %v, want a PartialError", err)
+	}
+	if e, ok := partial.Err.(*Error); !ok || e.Code != 451 || e.EnhancedCode != "4.4.1" {
+		t.Errorf("Temporary error %v, want 451 4.4.1", partial.Err)
+	}
+	if e, ok := partial.FailedErr.(*Error); !ok || e.Code != 550 {
+		t.Errorf("Permanent error %v, want 550", partial.FailedErr)
+	}
+	sort.Strings(partial.Failed)
+	if strings.Join(partial.Failed, ",") != "unknown@example.com,user@example.org" {
+		t.Errorf("Failed recipients %v", partial.Failed)
+	}
+	if strings.Join(env.To, ",") != "user@sub.example.net" {
+		t.Errorf("Remaining recipients %v", env.To)
+	}
+	if to := <-received; len(to) != 1 || to[0] != "user@example.com" {
+		t.Errorf("Upstream received message for %v", to)
+	}
+}
+
+func TestSmartHostDSN(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan *Envelope, 1)
+	go (&Server{Hostname: "upstream.example.com", HandlerMessage: func(env *Envelope, msg io.Reader) error {
+		received <- env
+		return nil
+	}}).Serve(ln)
+
+	// The DSN parameters of every recipient are relayed.
+	sh := &SmartHost{Hostname: "relay.example.com", Routes: map[string]*Route{"*": {Host: ln.Addr().String()}}}
+	err = sh.Deliver(&Envelope{
+		From:   "sender@example.org",
+		To:     []string{"quiet@example.com", "loud@example.com"},
+		Notify: map[string]string{"quiet@example.com": "NEVER", "loud@example.com": "SUCCESS,FAILURE"},
+		Ret:    "HDRS",
+		EnvID:  "abc123",
+	}, strings.NewReader("Subject: test\r\n\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := <-received
+	if env.Notify["quiet@example.com"] != "NEVER" || env.Notify["loud@example.com"] != "SUCCESS,FAILURE" {
+		t.Errorf("Upstream received NOTIFY %v", env.Notify)
+	}
+	if env.Ret != "HDRS" || env.EnvID != "abc123" {
+		t.Errorf("Upstream received RET %q and ENVID %q", env.Ret, env.EnvID)
+	}
+}
+
+func TestCmdDATASmartHost(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	addr, received := startUpstream(t)
+	q := &Queue{Dir: dir}
+	bounced := make(chan []string, 1)
+	q.HandlerFailed = func(env *Envelope, msg io.Reader, err error) {
+		bounced <- env.To
+	}
+	startHeldQueue(t, q)
+	defer q.Close()
+	sh := &SmartHost{Routes: map[string]*Route{
+		"example.com":   {Host: addr},
+		"*.example.net": {Host: closedAddr(t)},
+	}}
+	srv := &Server{HandlerRcpt: sh.HandlerRcpt, HandlerMessage: sh.HandlerMessage}
+
+	// Without a queue for partial failures, nothing is relayed.
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 451)
+
+	// Recipients without a route are rejected at RCPT.
+	sh.Queue = q
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@example.org>", 550)
+
+	// The upstream's reply is passed on instead of a generic 451 when nobody was delivered to.
+	cmdCode(t, conn, "RCPT TO:<unknown@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	msg := cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 550)
+	if !strings.HasPrefix(msg, "5.1.0 ") {
+		t.Errorf("DATA reply is %q, want upstream's 5.1.0", msg)
+	}
+
+	// A partial failure is accepted, the permanent failure is bounced at once
+	// and the temporary one queued.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<unknown@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@down.example.net>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	if to := <-received; len(to) != 1 || to[0] != "user@example.com" {
+		t.Errorf("Upstream received message for %v", to)
+	}
+	if to := <-bounced; len(to) != 1 || to[0] != "unknown@example.com" {
+		t.Errorf("Bounced %v, want unknown@example.com", to)
+	}
+	if n := spooled(t, dir); n != 1 {
+		t.Errorf("Spool contains %d messages, want 1 for the temporary failure", n)
+	}
+}
+
+func TestSmartHostQueued(t *testing.T) {
+	dir := tempQueueDir(t)
+	defer os.RemoveAll(dir)
+
+	// Relaying after queueing, with the smart host as the queue's Deliverer,
+	// relays every message once.
+	addr, received := startUpstream(t)
+	sh := &SmartHost{Routes: map[string]*Route{"example.com": {Host: addr}}}
+	q := &Queue{Dir: dir, Deliverer: sh}
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	conn := newConn(t, &Server{HandlerRcpt: sh.HandlerRcpt, Queue: q})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<user@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, mimeHeaders+"Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message was not relayed")
+	}
+	select {
+	case to := <-received:
+		t.Errorf("Message relayed again for %v", to)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -3,35 +3,69 @@ package smtpd
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/textproto"
 	"os"
 	"regexp"
+	"sync"
 	"time"
+
+	"github.com/Xeoncross/smtpd/milter"
 )
 
 var (
 	// Debug `true` enables verbose logging.
 	Debug      = false
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:<(.+?)>(\s(.*))?`)
 	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
 	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+
+	enhancedCodeRE = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
 )
 
+// Recipients accepted per message, the minimum RFC 5321 requires.
+const maxRecipients = 100
+
 // HandlerRcpt function called on RCPT. Return accept status.
 type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
 
+// HandlerConnect function called when a client connects, before the banner is sent.
+// tlsState is nil unless the connection uses implicit TLS. Return an *Error to
+// reject or tempfail the connection with that reply, other errors reply 554.
+type HandlerConnect func(remoteAddr net.Addr, tlsState *tls.ConnectionState) error
+
 // Handler function called to process email DATA body
 type Handler func(bytesRead int, remoteAddr net.Addr, from string, to []string, header textproto.MIMEHeader, body io.Reader) error
 
+// HandlerMessage function called once with the complete raw message, after milters and scanners.
+// Return an *Error to reply with it instead of the generic 451.
+type HandlerMessage func(env *Envelope, msg io.Reader) error
+
 // HandlerSuccess called after successful DATA body processed (used for stats)
 type HandlerSuccess func(bytesRead int, remoteAddr net.Addr, from string, to []string)
 
+// Envelope describes the mail transaction a message was received in.
+type Envelope struct {
+	ID          string // Queue ID, set once the message is queued
+	RemoteAddr  net.Addr
+	Conn        *ConnInfo // Connection the message was received on, nil once queued
+	Helo        string    // Hostname supplied with HELO/EHLO
+	From        string
+	To          []string
+	ORCPT       map[string]string    // Original recipient of addresses in To that were rewritten, e.g. by alias expansion
+	Auth        string               // Identity the client authenticated as, empty if it didn't
+	TLS         *tls.ConnectionState // TLS state of the connection including verified client certificates, nil without TLS or once queued
+	RequireTLS  bool                 // MAIL FROM had REQUIRETLS (RFC 8689): only relay over verified TLS to servers supporting REQUIRETLS
+	TLSOptional bool                 // The message has "TLS-Required: No" (RFC 8689 section 5), the sender prefers delivery over TLS policy
+	Ret         string               // RET given with MAIL FROM (RFC 3461): "FULL" or "HDRS" for the part of the message returned in a DSN
+	EnvID       string               // ENVID given with MAIL FROM, quoted in DSNs
+	Notify      map[string]string    // NOTIFY given with RCPT TO by recipient, e.g. "NEVER" or "FAILURE,DELAY"
+	Received    time.Time
+}
+
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
 // on incoming connections.
@@ -66,24 +100,76 @@ func (err maxSizeExceededError) Error() string {
 	return fmt.Sprintf("552 5.3.4 Requested mail action aborted: exceeded storage allocation (%d)", err.limit)
 }
 
+// Error is an SMTP reply returned by a handler or filter. It is sent to the
+// client as is, instead of the generic 451 response.
+type Error struct {
+	Code         int    // Reply code, e.g. 550
+	EnhancedCode string // RFC 3463 enhanced status code, e.g. "5.7.1"
+	Message      string
+}
+
+func (err *Error) Error() string {
+	if err.EnhancedCode == "" {
+		return fmt.Sprintf("%d %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%d %s %s", err.Code, err.EnhancedCode, err.Message)
+}
+
+// Temporary reports if the error is a 4xx reply.
+func (err *Error) Temporary() bool {
+	return err.Code >= 400 && err.Code < 500
+}
+
 // LogFunc is a function capable of logging the client-server communication.
 type LogFunc func(remoteIP, verb, line string)
 
 // Server is an SMTP server.
 type Server struct {
-	Addr           string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-	Appname        string
-	Handler        Handler
-	HandlerRcpt    HandlerRcpt
-	HandlerSuccess HandlerSuccess
-	Hostname       string
-	LogRead        LogFunc
-	LogWrite       LogFunc
-	MaxSize        int // Maximum message size allowed, in bytes
-	Timeout        time.Duration
-	TLSConfig      *tls.Config
-	TLSListener    bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
-	TLSRequired    bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Addr                string // TCP address to listen on, defaults to ":25" (all addresses, port 25), or ":587" in Submission mode, if empty
+	Appname             string
+	AuthInsecure        bool                // Allow AUTH on connections without TLS (not recommended)
+	Commands            map[string]*Command // Additional verbs by upper case name, built-in commands take precedence
+	ConnInfoAddr        bool                // Pass hooks the connection's *ConnInfo as remoteAddr instead of the client's address
+	ErrorLog            *log.Logger         // Errors that can't be reported to the client, such as a failing greylist store, defaults to the standard logger
+	GreetDelay          time.Duration       // Wait before sending the banner and reject clients that talk first, 0 disables
+	Greylist            *Greylist           // Greylisting applied to accepted recipients, disabled if nil
+	Handler             Handler
+	HandlerAuth         HandlerAuth
+	HandlerAuthExternal HandlerAuthExternal
+	HandlerConnect      HandlerConnect
+	HandlerETRN         HandlerETRN   // Starts queue runs for ETRN from authenticated or trusted clients, ETRN is disabled if nil
+	HandlerEXPN         HandlerVerify // Expands mailing lists for EXPN from authenticated or trusted clients, EXPN is disabled if nil
+	HandlerMessage      HandlerMessage
+	HandlerRcpt         HandlerRcpt
+	HandlerSender       HandlerSender
+	HandlerSuccess      HandlerSuccess
+	HandlerTLSError     HandlerTLSError
+	HandlerVRFY         HandlerVerify    // Answers VRFY from authenticated or trusted clients, others get 252
+	HeaderValidator     *HeaderValidator // Message headers are checked before milters and scanners run, optional
+	Hostname            string
+	Listeners           []*Listener // Addresses to listen on with their own TLS and AUTH settings, instead of Addr
+	LogRead             LogFunc
+	LogWrite            LogFunc
+	MaxSize             int              // Maximum message size allowed, in bytes
+	Milters             []*milter.Client // Mail filters consulted at every stage, in order
+	MilterFailOpen      bool             // Skip milters that can't be reached or fail, instead of replying 451
+	Queue               *Queue           // Accepted messages are queued for delivery before replying 250, after Handler and HandlerMessage ran, optional
+	Recipients          *RecipientPolicy // Recipients are validated on RCPT, optional
+	Scanners            []Scanner        // Content scanners run on every message before it is accepted, in order
+	ScanFailOpen        bool             // Accept messages when a scanner fails, instead of replying 451
+	Submission          bool             // Message submission (RFC 6409): require AUTH before MAIL and fix up messages
+	Timeout             time.Duration
+	TLSConfig           *tls.Config
+	TLSListener         bool         // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSRequired         bool         // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	TrustedNetworks     []*net.IPNet // Clients allowed VRFY, EXPN and ETRN without AUTH
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	activated map[string][]net.Listener // Sockets passed by systemd not yet used by a Listener
+	sema      chan struct{}             // Limits sessions across all listeners
+	sessions  sync.WaitGroup            // Sessions in progress
 }
 
 // ConfigureTLS creates a TLS configuration from certificate and key files.
@@ -103,24 +189,7 @@ func (srv *Server) ConfigureTLSWithPassphrase(
 	keyFile string,
 	passphrase string,
 ) error {
-	certPEMBlock, err := ioutil.ReadFile(certFile)
-	if err != nil {
-		return err
-	}
-	keyPEMBlock, err := ioutil.ReadFile(keyFile)
-	if err != nil {
-		return err
-	}
-	keyDERBlock, _ := pem.Decode(keyPEMBlock)
-	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
-	if err != nil {
-		return err
-	}
-	var pemBlock pem.Block
-	pemBlock.Type = keyDERBlock.Type
-	pemBlock.Bytes = keyPEMDecrypted
-	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
-	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	cert, err := loadKeyPair(certFile, keyFile, passphrase)
 	if err != nil {
 		return err
 	}
@@ -128,10 +197,13 @@ func (srv *Server) ConfigureTLSWithPassphrase(
 	return nil
 }
 
-// ListenAndServe listens on the TCP network address srv.Addr and then
-// calls Serve to handle requests on incoming connections.  If
-// srv.Addr is blank, ":25" is used.
+// ListenAndServe listens on every address in srv.Listeners, or on the TCP
+// network address srv.Addr if there are none, and then calls Serve to handle
+// requests on incoming connections.  If srv.Addr is blank, ":25" is used.
 func (srv *Server) ListenAndServe() error {
+	if srv.Addr == "" && srv.Submission {
+		srv.Addr = ":587"
+	}
 	if srv.Addr == "" {
 		srv.Addr = ":25"
 	}
@@ -145,44 +217,34 @@ func (srv *Server) ListenAndServe() error {
 		srv.Timeout = 5 * time.Minute
 	}
 
-	var ln net.Listener
-	var err error
-
-	// If TLSListener is enabled, listen for TLS connections only.
-	if srv.TLSConfig != nil && srv.TLSListener {
-		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
-	} else {
-		ln, err = net.Listen("tcp", srv.Addr)
-	}
-	if err != nil {
-		return err
+	listeners := srv.Listeners
+	if len(listeners) == 0 {
+		l := &Listener{Addr: srv.Addr}
+		// If TLSListener is enabled, listen for TLS connections only.
+		if srv.TLSListener {
+			l.TLS = TLSImplicit
+		}
+		listeners = []*Listener{l}
 	}
-	return srv.Serve(ln)
+	return srv.listenAndServeAll(listeners)
 }
 
 // Serve creates a new SMTP session after a network connection is established.
 func (srv *Server) Serve(ln net.Listener) error {
-	defer ln.Close()
-
-	// Request throttler limits how many clients we're talking to at a time
-	// The rest pool up, waiting their turn
-	sema := make(chan struct{}, 200)
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				continue
-			}
-			return err
-		}
+	return srv.serve(ln, nil)
+}
 
-		sema <- struct{}{}
-		session := srv.newSession(conn)
-		go func() {
-			session.serve()
-			<-sema
-		}()
+// Log an error that can't be reported to the client.
+func (srv *Server) logf(format string, args ...interface{}) {
+	logf(srv.ErrorLog, format, args...)
+}
+
+// Log to l, or to the standard logger if l is nil.
+func logf(l *log.Logger, format string, args ...interface{}) {
+	if l != nil {
+		l.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
 	}
 }
 
@@ -198,6 +260,8 @@ func (srv *Server) newSession(conn net.Conn) (s *session) {
 		// https://golang.org/src/net/textproto/reader.go#L281
 		// https://golang.org/src/net/textproto/writer.go#L36
 		tpconn: textproto.NewConn(conn),
+
+		info: &ConnInfo{RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()},
 	}
 
 	// Get remote end info for the Received header.
@@ -83,7 +83,8 @@ func TestSimpleCommands(t *testing.T) {
 		{"NOOP", 250},
 		{"RSET", 250},
 		{"HELP", 502},
-		{"VRFY", 502},
+		{"VRFY", 501}, // Missing argument
+		{"VRFY user@example.com", 252},
 		{"EXPN", 502},
 		{"TEST", 500}, // Unsupported command
 		{"", 500},     // Blank command
@@ -750,3 +751,57 @@ func TestConfigureTLSWithPassphrase(t *testing.T) {
 		t.Errorf("Unexpected empty TLS config.")
 	}
 }
+
+func TestHandlerConnect(t *testing.T) {
+	server := &Server{
+		HandlerConnect: func(remoteAddr net.Addr, tlsState *tls.ConnectionState) error {
+			if tlsState != nil {
+				t.Errorf("HandlerConnect received TLS state for a plain connection")
+			}
+			return &Error{Code: 421, EnhancedCode: "4.7.0", Message: "Too busy, try again later"}
+		},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go server.newSession(serverConn).serve()
+
+	_, msg, err := textproto.NewConn(clientConn).ReadCodeLine(421)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "4.7.0 Too busy, try again later" {
+		t.Errorf("Banner is %q, want custom reply", msg)
+	}
+	clientConn.Close()
+
+	// Accepted connections get the normal banner.
+	server.HandlerConnect = func(remoteAddr net.Addr, tlsState *tls.ConnectionState) error {
+		return nil
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestGreetDelay(t *testing.T) {
+	server := &Server{GreetDelay: 50 * time.Millisecond}
+
+	// Clients that wait for the banner are served normally.
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Clients that talk first are rejected.
+	clientConn, serverConn := net.Pipe()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go server.newSession(serverConn).serve()
+
+	go fmt.Fprintf(clientConn, "EHLO host.example.com\r\n")
+	_, _, err := textproto.NewConn(clientConn).ReadCodeLine(554)
+	if err != nil {
+		t.Error(err)
+	}
+	clientConn.Close()
+}
@@ -0,0 +1,175 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+var errNotActivated = errors.New("smtpd: no socket passed by systemd")
+
+// Listen on a Unix socket, removing a stale socket left behind by a previous
+// run and applying the listener's permissions and ownership.
+func listenUnix(l *Listener) (net.Listener, error) {
+	if fi, err := os.Stat(l.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// A socket nobody is listening on is stale, anything else is in use.
+		conn, err := net.Dial("unix", l.Addr)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("smtpd: %s is in use", l.Addr)
+		}
+		os.Remove(l.Addr)
+	}
+
+	// Bind in a private directory and move the socket into place once its
+	// permissions are set, so it is never reachable with the default ones.
+	dir, err := ioutil.TempDir(filepath.Dir(l.Addr), ".smtpd")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	err = chownSocket(tmp, l)
+	if err == nil && l.Mode != 0 {
+		err = os.Chmod(tmp, l.Mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.Addr)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: l.Addr}, nil
+}
+
+// unixListener is a Unix socket that was bound under another name and moved to path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close removes the socket, like net.UnixListener does for the name it bound.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// Change the owner and group of a Unix socket to the listener's, if set.
+func chownSocket(path string, l *Listener) error {
+	if l.Owner == "" && l.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if l.Owner != "" {
+		u, err := user.Lookup(l.Owner)
+		if err != nil {
+			return err
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return err
+		}
+	}
+	if l.Group != "" {
+		g, err := user.LookupGroup(l.Group)
+		if err != nil {
+			return err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Take the next socket passed by systemd with the given name.
+func (srv *Server) activatedListener(name string) (net.Listener, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.activated == nil {
+		activated, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		srv.activated = activated
+	}
+	lns := srv.activated[name]
+	if len(lns) == 0 {
+		return nil, errNotActivated
+	}
+	srv.activated[name] = lns[1:]
+	return lns[0], nil
+}
+
+// Adopt the sockets passed with socket activation (sd_listen_fds(3)), by
+// name. Sockets without a name are called "unknown", like systemd does.
+func systemdListeners() (map[string][]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return map[string][]net.Listener{}, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return map[string][]net.Listener{}, nil
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	// The descriptors must not be passed on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return listenersFromFDs(listenFDsStart, n, names)
+}
+
+// Create listeners from n consecutive file descriptors starting at first.
+func listenersFromFDs(first int, n int, names []string) (map[string][]net.Listener, error) {
+	activated := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		ln, err := net.FileListener(f)
+		// FileListener dups the descriptor, with close-on-exec set.
+		f.Close()
+		if err != nil {
+			for _, lns := range activated {
+				for _, ln := range lns {
+					ln.Close()
+				}
+			}
+			return nil, fmt.Errorf("smtpd: socket %q passed by systemd: %v", name, err)
+		}
+		activated[name] = append(activated[name], ln)
+	}
+	return activated, nil
+}
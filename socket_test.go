@@ -0,0 +1,113 @@
+//go:build !windows
+// +build !windows
+
+package smtpd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smtpd.sock")
+
+	// Leave a stale socket behind, as a crashed server would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := &Server{Hostname: "mail.example.com"}
+	l := &Listener{Network: "unix", Addr: path, Mode: 0660}
+	ln, err := srv.listen(l)
+	if err != nil {
+		t.Fatalf("Stale socket not removed: %v", err)
+	}
+	go srv.serve(ln, l)
+	defer srv.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("Socket mode %v, want 0660", fi.Mode().Perm())
+	}
+
+	// A socket that is in use isn't taken over.
+	if _, err := srv.listen(l); err == nil {
+		t.Error("Listening on a socket in use succeeded")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := textproto.NewConn(conn)
+	defer tc.Close()
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	cmdResponse(t, tc, "EHLO client.example.com", 250)
+
+	// Closing removes the socket, and binding left nothing else behind.
+	srv.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Directory has %d entries after Close, want 0", len(files))
+	}
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// listenersFromFDs closes the descriptor it is given.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activated, err := listenersFromFDs(fd, 1, []string{"smtp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activated["smtp"]) != 1 || activated["smtp"][0].Addr().String() != tcp.Addr().String() {
+		t.Fatalf("Activated listeners %v", activated)
+	}
+
+	srv := &Server{activated: activated}
+	ln, err := srv.listen(&Listener{Name: "smtp"})
+	if err != nil || ln.Addr().String() != tcp.Addr().String() {
+		t.Errorf("listen returned %v, %v", ln, err)
+	}
+	ln.Close()
+
+	// Every socket is only adopted once, then Addr is used instead.
+	if _, err := srv.listen(&Listener{Name: "smtp"}); err != errNotActivated {
+		t.Errorf("listen returned %v, want errNotActivated", err)
+	}
+	ln, err = srv.listen(&Listener{Name: "smtp", Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
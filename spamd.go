@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spamd scans messages with SpamAssassin's spamd daemon.
+type Spamd struct {
+	Network       string        // "tcp" or "unix", defaults to "tcp"
+	Address       string        // Defaults to "127.0.0.1:783"
+	Command       string        // "CHECK" or "SYMBOLS", defaults to "SYMBOLS"
+	User          string        // User whose preferences are used, optional
+	Timeout       time.Duration // Timeout for the whole scan, defaults to 30 seconds
+	RejectScore   float64       // Reject messages scoring at least this much, 0 disables
+	TempFailScore float64       // Tempfail messages scoring at least this much, 0 disables
+}
+
+// Scan sends the message to spamd and parses the verdict.
+func (sd *Spamd) Scan(env *Envelope, msg io.Reader, size int64) (*ScanResult, error) {
+	network, address, command := sd.Network, sd.Address, sd.Command
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = "127.0.0.1:783"
+	}
+	if command == "" {
+		command = "SYMBOLS"
+	}
+	timeout := sd.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s SPAMC/1.5\r\nContent-length: %d\r\n", command, size)
+	if sd.User != "" {
+		fmt.Fprintf(w, "User: %s\r\n", sd.User)
+	}
+	w.WriteString("\r\n")
+	_, err = io.Copy(w, msg)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, threshold, err := parseSpamdResponse(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	res.Header = spamHeader(res, threshold)
+	res.Reply = scoreReply(res.Score, sd.RejectScore, sd.TempFailScore)
+	return res, nil
+}
+
+// Parse a response such as:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 23
+//	Spam: True ; 15.0 / 5.0
+//
+//	BAYES_99,HTML_MESSAGE
+func parseSpamdResponse(r *bufio.Reader) (res *ScanResult, threshold float64, err error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SPAMD/") {
+		return nil, 0, fmt.Errorf("spamd: invalid response %q", line)
+	}
+	if parts[1] != "0" {
+		return nil, 0, fmt.Errorf("spamd: %s", strings.Join(parts[1:], " "))
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	// Spam: True ; 15.0 / 5.0
+	spam := header.Get("Spam")
+	fields := strings.FieldsFunc(spam, func(r rune) bool { return r == ';' || r == '/' || r == ' ' })
+	if len(fields) != 3 {
+		return nil, 0, errors.New("spamd: missing Spam header")
+	}
+	res = &ScanResult{}
+	res.Spam = strings.EqualFold(fields[0], "true") || strings.EqualFold(fields[0], "yes")
+	res.Score, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	threshold, err = strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// SYMBOLS responses list the matched rules in the body.
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			res.Symbols = append(res.Symbols, symbol)
+		}
+	}
+	return res, threshold, nil
+}
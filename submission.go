@@ -0,0 +1,76 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Trace fields are added by servers, never by the submitting client (RFC 5321 section 4.4).
+var traceHeaders = map[string]bool{"Received": true, "Return-Path": true}
+
+var errSenderNotOwned = &Error{Code: 550, EnhancedCode: "5.7.1", Message: "From address not owned by authenticated user"}
+
+// Fix up a submitted message (RFC 6409 section 8): strip trace fields, check the
+// From addresses belong to the authenticated identity, add a missing Date and
+// Message-ID and prepend our own Received field.
+func (s *session) submitMessage(msg []byte) ([]byte, error) {
+	fields, body := splitMessage(msg)
+
+	kept := []headerField{{"Received", s.receivedHeader()}}
+	hasDate, hasID := false, false
+	for _, f := range fields {
+		name := textproto.CanonicalMIMEHeaderKey(f.Name)
+		if traceHeaders[name] {
+			continue
+		}
+		switch name {
+		case "From":
+			if s.srv.HandlerSender != nil {
+				list, err := mail.ParseAddressList(strings.Replace(f.Value, "\r\n", "", -1))
+				if err != nil {
+					return nil, invalidHeader("invalid address in From")
+				}
+				for _, addr := range list {
+					if !s.srv.HandlerSender(s.auth, addr.Address) {
+						return nil, errSenderNotOwned
+					}
+				}
+			}
+		case "Date":
+			hasDate = true
+		case "Message-Id":
+			hasID = true
+		}
+		kept = append(kept, f)
+	}
+
+	if !hasDate {
+		kept = append(kept, headerField{"Date", time.Now().Format(time.RFC1123Z)})
+	}
+	if !hasID {
+		id, err := newMessageID(s.srv.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, headerField{"Message-ID", id})
+	}
+	return joinMessage(kept, body), nil
+}
+
+// Value of the Received field for a submitted message, see RFC 3848 for ESMTPSA.
+func (s *session) receivedHeader() string {
+	protocol := "ESMTPA"
+	if s.tls {
+		protocol = "ESMTPSA"
+	}
+	ip := s.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return fmt.Sprintf("from %s ([%s])\r\n\tby %s (%s) with %s; %s",
+		s.remoteName, ip, s.srv.Hostname, s.srv.Appname, protocol, time.Now().Format(time.RFC1123Z))
+}
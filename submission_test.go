@@ -0,0 +1,240 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuth(remoteAddr net.Addr, mechanism string, username string, password string) (bool, error) {
+	if username == "broken" {
+		return false, errors.New("database unavailable")
+	}
+	return username == "user@example.com" && password == "secret", nil
+}
+
+func testSender(identity string, sender string) bool {
+	return strings.EqualFold(identity, sender)
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestCmdAUTH(t *testing.T) {
+	// Without TLS, AUTH is neither advertised nor accepted.
+	conn := newConn(t, &Server{HandlerAuth: testAuth})
+	if msg := cmdCode(t, conn, "EHLO host.example.com", 250); strings.Contains(msg, "AUTH") {
+		t.Errorf("AUTH advertised without TLS: %q", msg)
+	}
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 538)
+	conn.Close()
+
+	conn = newConn(t, &Server{HandlerAuth: testAuth, AuthInsecure: true})
+	if msg := cmdCode(t, conn, "EHLO host.example.com", 250); !strings.Contains(msg, "AUTH PLAIN LOGIN") {
+		t.Errorf("AUTH not advertised: %q", msg)
+	}
+	cmdCode(t, conn, "AUTH CRAM-MD5", 504)
+	cmdCode(t, conn, "AUTH PLAIN not-base64!", 501)
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00wrong"), 535)
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00broken\x00secret"), 454)
+
+	// Cancelled exchange.
+	cmdCode(t, conn, "AUTH LOGIN", 334)
+	cmdCode(t, conn, "*", 501)
+
+	// LOGIN with challenges.
+	cmdCode(t, conn, "AUTH LOGIN", 334)
+	cmdCode(t, conn, b64("user@example.com"), 334)
+	cmdCode(t, conn, b64("secret"), 235)
+	cmdCode(t, conn, "AUTH PLAIN", 503)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// PLAIN with the response after a 334 prompt.
+	conn = newConn(t, &Server{HandlerAuth: testAuth, AuthInsecure: true})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "AUTH PLAIN", 334)
+	cmdCode(t, conn, b64("user@example.com\x00user@example.com\x00secret"), 235)
+
+	// AUTH isn't allowed during a transaction.
+	conn2 := newConn(t, &Server{HandlerAuth: testAuth, AuthInsecure: true})
+	cmdCode(t, conn2, "EHLO host.example.com", 250)
+	cmdCode(t, conn2, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn2, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 503)
+	conn2.Close()
+	conn.Close()
+}
+
+func TestSubmission(t *testing.T) {
+	var got []byte
+	var gotEnv *Envelope
+	srv := &Server{
+		Hostname:      "submit.example.com",
+		Submission:    true,
+		AuthInsecure:  true,
+		HandlerAuth:   testAuth,
+		HandlerSender: testSender,
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			gotEnv = env
+			got, _ = ioutil.ReadAll(msg)
+			return nil
+		},
+	}
+
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "EHLO client.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<user@example.com>", 530)
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 235)
+	cmdCode(t, conn, "MAIL FROM:<other@example.com>", 553)
+	cmdCode(t, conn, "MAIL FROM:<user@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.net>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "From: Other <other@example.com>\r\n\r\nTest message.\r\n.", 550)
+
+	cmdCode(t, conn, "MAIL FROM:<user@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.net>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Received: from forged.example.org\r\nFrom: User <user@example.com>\r\nSubject: test\r\n\r\nTest message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	if gotEnv == nil || gotEnv.Auth != "user@example.com" {
+		t.Fatalf("Envelope %+v", gotEnv)
+	}
+	fields, body := splitMessage(got)
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "Received From Subject Date Message-ID" {
+		t.Errorf("Header fields %v", names)
+	}
+	if !strings.Contains(fields[0].Value, "by submit.example.com") || !strings.Contains(fields[0].Value, "with ESMTPA;") {
+		t.Errorf("Received: %s", fields[0].Value)
+	}
+	if !strings.HasSuffix(fields[4].Value, "@submit.example.com>") {
+		t.Errorf("Message-ID: %s", fields[4].Value)
+	}
+	if !bytes.Contains(body, []byte("Test message.")) {
+		t.Errorf("Body %q", body)
+	}
+}
+
+// Self-signed client certificate for name.
+func clientCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestAuthExternal(t *testing.T) {
+	trusted := clientCertificate(t, "relay1.example.com")
+	untrusted := clientCertificate(t, "relay2.example.com")
+	pool := x509.NewCertPool()
+	pool.AddCert(trusted.Leaf)
+
+	var gotEnv *Envelope
+	srv := &Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		},
+		HandlerAuthExternal: func(remoteAddr net.Addr, cert *x509.Certificate, authzid string) (string, error) {
+			if authzid != "" && authzid != cert.Subject.CommonName {
+				return "", nil
+			}
+			return cert.Subject.CommonName, nil
+		},
+		HandlerMessage: func(env *Envelope, msg io.Reader) error {
+			gotEnv = env
+			return nil
+		},
+	}
+
+	// Upgrade to TLS, presenting certs, and return the EHLO reply.
+	starttls := func(certs []tls.Certificate) (*textproto.Conn, string) {
+		conn := newConn(t, srv)
+		cmdCode(t, conn, "EHLO client.example.com", 250)
+		cmdCode(t, conn, "STARTTLS", 220)
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		tc := textproto.NewConn(tlsConn)
+		return tc, cmdResponse(t, tc, "EHLO client.example.com", 250)
+	}
+
+	// Without a certificate, EXTERNAL isn't offered.
+	tc, ehlo := starttls(nil)
+	if strings.Contains(ehlo, "EXTERNAL") {
+		t.Errorf("EXTERNAL advertised without a client certificate: %q", ehlo)
+	}
+	cmdResponse(t, tc, "AUTH EXTERNAL", 502)
+	tc.Close()
+
+	// An unverified certificate fails the handshake, which TLS 1.3 clients
+	// only see when they next read.
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		// Send the certificate even though the server doesn't list its issuer.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &untrusted, nil },
+	})
+	if err := tlsConn.Handshake(); err == nil {
+		tc := textproto.NewConn(tlsConn)
+		tc.PrintfLine("EHLO client.example.com")
+		if _, msg, err := tc.ReadResponse(250); err == nil {
+			t.Errorf("Untrusted client certificate accepted: %q", msg)
+		}
+	}
+	conn.Close()
+
+	tc, ehlo = starttls([]tls.Certificate{trusted})
+	if !strings.Contains(ehlo, "AUTH EXTERNAL") {
+		t.Errorf("EXTERNAL not advertised: %q", ehlo)
+	}
+	cmdResponse(t, tc, "AUTH EXTERNAL "+b64("someone.example.com"), 535)
+	cmdResponse(t, tc, "AUTH EXTERNAL", 334)
+	cmdResponse(t, tc, "=", 235)
+	cmdResponse(t, tc, "MAIL FROM:<sender@example.com>", 250)
+	cmdResponse(t, tc, "RCPT TO:<recipient@example.com>", 250)
+	cmdResponse(t, tc, "DATA", 354)
+	cmdResponse(t, tc, "Subject: test\r\n\r\nTest message.\r\n.", 250)
+	tc.Close()
+
+	if gotEnv == nil || gotEnv.Auth != "relay1.example.com" || gotEnv.TLS == nil || len(gotEnv.TLS.VerifiedChains) == 0 {
+		t.Errorf("Envelope %+v", gotEnv)
+	}
+}
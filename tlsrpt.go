@@ -0,0 +1,133 @@
+package smtpd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// TLSReport is an SMTP TLS report (RFC 8460 section 4).
+type TLSReport struct {
+	OrganizationName string            `json:"organization-name"`
+	DateRange        TLSReportRange    `json:"date-range"`
+	ContactInfo      string            `json:"contact-info"`
+	ReportID         string            `json:"report-id"`
+	Policies         []TLSReportPolicy `json:"policies"`
+}
+
+// TLSReportRange is the period a report covers.
+type TLSReportRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// TLSReportPolicy is the result of applying one policy.
+type TLSReportPolicy struct {
+	Policy struct {
+		Type   string   `json:"policy-type"` // "sts", "tlsa" or "no-policy-found"
+		String []string `json:"policy-string"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int64 `json:"total-successful-session-count"`
+		Failed     int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []TLSReportFailure `json:"failure-details"`
+}
+
+// TLSReportFailure describes sessions that failed for the same reason.
+type TLSReportFailure struct {
+	ResultType            string `json:"result-type"` // e.g. "certificate-expired" or "sts-policy-fetch-error"
+	SendingMTAIP          string `json:"sending-mta-ip"`
+	ReceivingMXHostname   string `json:"receiving-mx-hostname"`
+	ReceivingMXHelo       string `json:"receiving-mx-helo"`
+	ReceivingIP           string `json:"receiving-ip"`
+	FailedSessionCount    int64  `json:"failed-session-count"`
+	AdditionalInformation string `json:"additional-information"`
+	FailureReasonCode     string `json:"failure-reason-code"`
+}
+
+// Reports larger than this once decompressed are rejected.
+const maxTLSReportSize = 10 << 20
+
+var (
+	errNotTLSReport      = &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Message has no TLS report"}
+	errTLSReportTooLarge = &Error{Code: 552, EnhancedCode: "5.3.4", Message: "TLS report exceeds size limit"}
+	errInvalidTLSReport  = &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Invalid TLS report"}
+)
+
+// ParseTLSReport parses a JSON report, gzipped or not.
+func ParseTLSReport(r io.Reader) (*TLSReport, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errInvalidTLSReport
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var report TLSReport
+	err := json.NewDecoder(&limitedReader{R: r, N: maxTLSReportSize, Err: errTLSReportTooLarge}).Decode(&report)
+	if err == errTLSReportTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errInvalidTLSReport
+	}
+	return &report, nil
+}
+
+// ParseTLSReportMessage finds and parses the report in a message sent to a
+// TLS-RPT rua=mailto: address (RFC 8460 section 5.3).
+func ParseTLSReportMessage(msg io.Reader) (*TLSReport, error) {
+	var report *TLSReport
+	w := &mimeWalker{MaxParts: 20, MaxDepth: 5}
+	err := w.walkMessage(msg, func(p *mimePart) error {
+		if report != nil || !isTLSReportPart(p) {
+			return nil
+		}
+		var err error
+		report, err = ParseTLSReport(p.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, errNotTLSReport
+	}
+	return report, nil
+}
+
+// Reports are application/tlsrpt+gzip or application/tlsrpt+json, some senders
+// use generic types with a .json or .json.gz filename.
+func isTLSReportPart(p *mimePart) bool {
+	switch p.MediaType {
+	case "application/tlsrpt+gzip", "application/tlsrpt+json":
+		return true
+	case "application/gzip", "application/x-gzip", "application/json", "application/octet-stream":
+		name := strings.ToLower(p.Filename)
+		return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")
+	}
+	return false
+}
+
+// TLSReportHandler returns a HandlerMessage that parses the TLS report in every
+// message and passes it to fn. Messages without a valid report are rejected.
+func TLSReportHandler(fn func(env *Envelope, report *TLSReport) error) HandlerMessage {
+	return func(env *Envelope, msg io.Reader) error {
+		report, err := ParseTLSReportMessage(msg)
+		if err != nil {
+			return err
+		}
+		return fn(env, report)
+	}
+}
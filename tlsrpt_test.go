@@ -0,0 +1,97 @@
+package smtpd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const testTLSReport = `{
+  "organization-name": "Company-X",
+  "date-range": {"start-datetime": "2016-04-01T00:00:00Z", "end-datetime": "2016-04-01T23:59:59Z"},
+  "contact-info": "sts-reporting@company-x.example",
+  "report-id": "5065427c-23d3-47ca-b6e0-946ea0e8c4be",
+  "policies": [{
+    "policy": {"policy-type": "sts", "policy-string": ["version: STSv1", "mode: testing"], "policy-domain": "company-y.example", "mx-host": ["*.mail.company-y.example"]},
+    "summary": {"total-successful-session-count": 5326, "total-failure-session-count": 303},
+    "failure-details": [{
+      "result-type": "certificate-expired",
+      "sending-mta-ip": "2001:db8:abcd:0012::1",
+      "receiving-mx-hostname": "mx1.mail.company-y.example",
+      "failed-session-count": 100
+    }]
+  }]
+}`
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestParseTLSReportMessage(t *testing.T) {
+	msg := "From: noreply@company-x.example\r\n" +
+		"Subject: Report Domain: company-y.example\r\n" +
+		"TLS-Report-Domain: company-y.example\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is an aggregate TLS report.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/tlsrpt+gzip\r\n" +
+		"Content-Disposition: attachment; filename=\"company-x.example!company-y.example!1459468800!1459555199.json.gz\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(gzipped(t, testTLSReport)) + "\r\n" +
+		"--b--\r\n"
+
+	var got *TLSReport
+	handler := TLSReportHandler(func(env *Envelope, report *TLSReport) error {
+		got = report
+		return nil
+	})
+	if err := handler(&Envelope{}, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if got.OrganizationName != "Company-X" || got.DateRange.Start.Day() != 1 || len(got.Policies) != 1 {
+		t.Fatalf("Report %+v", got)
+	}
+	p := got.Policies[0]
+	if p.Policy.Type != "sts" || p.Policy.Domain != "company-y.example" || p.Summary.Failed != 303 ||
+		len(p.FailureDetails) != 1 || p.FailureDetails[0].ResultType != "certificate-expired" || p.FailureDetails[0].FailedSessionCount != 100 {
+		t.Errorf("Policy %+v", p)
+	}
+
+	// Plain JSON reports work too.
+	if _, err := ParseTLSReport(strings.NewReader(testTLSReport)); err != nil {
+		t.Errorf("ParseTLSReport: %v", err)
+	}
+}
+
+func TestParseTLSReportErrors(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{"Subject: hello\r\n\r\nNot a report.\r\n", errNotTLSReport},
+		{"Content-Type: application/tlsrpt+json\r\n\r\n{not json", errInvalidTLSReport},
+	}
+	for _, tt := range tests {
+		if _, err := ParseTLSReportMessage(strings.NewReader(tt.msg)); err != tt.want {
+			t.Errorf("ParseTLSReportMessage(%q) returned %v, want %v", tt.msg, err, tt.want)
+		}
+	}
+
+	// Decompression bombs are stopped.
+	bomb := gzipped(t, `{"organization-name": "`+strings.Repeat("x", maxTLSReportSize)+`"}`)
+	if _, err := ParseTLSReport(bytes.NewReader(bomb)); err != errTLSReportTooLarge {
+		t.Errorf("ParseTLSReport of a large report returned %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+)
+
+// HandlerVerify function called for VRFY with the address or name to verify,
+// and for EXPN with the mailing list to expand. Return the matching mailboxes
+// or list members, or an *Error to reply with it.
+type HandlerVerify func(remoteAddr net.Addr, address string) ([]string, error)
+
+// Reports if the client may use VRFY, EXPN and ETRN: authenticated clients
+// and clients in TrustedNetworks.
+func (s *session) trustedClient() bool {
+	if s.auth != "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range s.srv.TrustedNetworks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strip the angle brackets clients may put around the argument.
+func verifyArg(args string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(args), "<"), ">")
+}
+
+// Handle VRFY (RFC 5321 section 3.5). Anyone else gets 252, which neither
+// confirms nor denies the address (section 7.3).
+func (s *session) handleVerify(args string) {
+	arg := verifyArg(args)
+	if arg == "" {
+		s.writef("501 5.5.4 Syntax error in parameters or arguments")
+		return
+	}
+	if s.srv.HandlerVRFY == nil || !s.trustedClient() {
+		s.writef("252 2.5.2 Cannot VRFY user, but will accept message and attempt delivery")
+		return
+	}
+
+	mailboxes, err := s.srv.HandlerVRFY(s.hookAddr(), arg)
+	if err != nil {
+		s.writeVerifyError(err)
+		return
+	}
+	switch len(mailboxes) {
+	case 0:
+		s.writef("550 5.1.1 User unknown")
+	case 1:
+		s.writef("250 2.1.5 <%s>", mailboxes[0])
+	default:
+		s.writeMultiline(553, "5.1.4", "User ambiguous", mailboxes)
+	}
+}
+
+// Handle EXPN (RFC 5321 section 3.5), which is disabled for anyone else.
+func (s *session) handleExpand(args string) {
+	if s.srv.HandlerEXPN == nil || !s.trustedClient() {
+		s.writef("502 5.5.1 Command not implemented")
+		return
+	}
+	arg := verifyArg(args)
+	if arg == "" {
+		s.writef("501 5.5.4 Syntax error in parameters or arguments")
+		return
+	}
+
+	members, err := s.srv.HandlerEXPN(s.hookAddr(), arg)
+	if err != nil {
+		s.writeVerifyError(err)
+		return
+	}
+	if len(members) == 0 {
+		s.writef("550 5.1.1 Mailing list unknown")
+		return
+	}
+	s.writeMultiline(250, "2.1.5", "", members)
+}
+
+func (s *session) writeVerifyError(err error) {
+	if smtpErr, ok := err.(*Error); ok {
+		s.writef("%s", smtpErr.Error())
+		return
+	}
+	s.writef("451 4.3.0 Requested action aborted: %s", err)
+}
+
+// Write a reply listing mailboxes, one per line, after an optional first line.
+func (s *session) writeMultiline(code int, enhancedCode string, first string, mailboxes []string) {
+	var lines []string
+	if first != "" {
+		lines = append(lines, first)
+	}
+	for _, m := range mailboxes {
+		lines = append(lines, "<"+m+">")
+	}
+	s.Reply(code, enhancedCode, "%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,78 @@
+package smtpd
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCmdVRFYAndEXPN(t *testing.T) {
+	store := NewMemoryRecipientStore("example.com")
+	store.AddMailbox("user@example.com")
+	store.AddMailbox("other@example.com")
+	store.AddAlias("list@example.com", "user@example.com", "other@example.com")
+	policy := &RecipientPolicy{Store: store, ExpandAliases: true}
+
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	srv := &Server{
+		HandlerAuth:  testAuth,
+		AuthInsecure: true,
+		HandlerVRFY: func(remoteAddr net.Addr, address string) ([]string, error) {
+			if address == "ambiguous" {
+				return []string{"user@example.com", "other@example.com"}, nil
+			}
+			if _, err := policy.Check(address); err != nil {
+				return nil, err
+			}
+			return []string{address}, nil
+		},
+		HandlerEXPN: func(remoteAddr net.Addr, address string) ([]string, error) {
+			return policy.Expand(address)
+		},
+		TrustedNetworks: []*net.IPNet{trusted},
+	}
+
+	// Anonymous clients learn nothing.
+	conn := newConn(t, srv)
+	cmdCode(t, conn, "VRFY user@example.com", 252)
+	cmdCode(t, conn, "VRFY nobody@example.com", 252)
+	cmdCode(t, conn, "EXPN list@example.com", 502)
+
+	cmdCode(t, conn, "AUTH PLAIN "+b64("\x00user@example.com\x00secret"), 235)
+	if msg := cmdCode(t, conn, "VRFY <user@example.com>", 250); msg != "2.1.5 <user@example.com>" {
+		t.Errorf("VRFY replied %q", msg)
+	}
+	cmdCode(t, conn, "VRFY nobody@example.com", 550)
+	cmdCode(t, conn, "VRFY ambiguous", 553)
+	cmdCode(t, conn, "VRFY", 501)
+	if msg := cmdCode(t, conn, "EXPN list@example.com", 250); msg != "2.1.5 <user@example.com>\n2.1.5 <other@example.com>" {
+		t.Errorf("EXPN replied %q", msg)
+	}
+	cmdCode(t, conn, "EXPN nobody@example.com", 550)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestVerifyTrustedNetworks(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &session{srv: &Server{TrustedNetworks: []*net.IPNet{loopback}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s.conn = conn
+	if !s.trustedClient() {
+		t.Error("Client in a trusted network not allowed")
+	}
+
+	s.srv.TrustedNetworks = nil
+	if s.trustedClient() {
+		t.Error("Untrusted, unauthenticated client allowed")
+	}
+}
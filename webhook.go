@@ -0,0 +1,271 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook posts every message to an HTTP endpoint as JSON. It can be used as the
+// Server's HandlerMessage or as a Queue's Deliverer.
+//
+// With Secret set, requests carry X-Webhook-Timestamp and X-Webhook-Signature
+// headers. The signature is "sha256=" followed by the hex HMAC-SHA256 of the
+// timestamp, a dot and the request body.
+//
+// 2xx replies accept the message. 4xx replies reject it with 550, except 408 and
+// 429 which are retried like 5xx replies and network errors: Retries more times,
+// then 451.
+type Webhook struct {
+	URL        string
+	Secret     string        // HMAC key for signing requests, optional
+	Multipart  bool          // Send attachments as multipart/form-data file parts instead of base64 in the JSON
+	Client     *http.Client  // Defaults to a client using Timeout
+	Timeout    time.Duration // Timeout for each request, defaults to 30 seconds
+	Retries    int           // Extra attempts before giving up with 451
+	RetryDelay time.Duration // Delay between attempts, defaults to 1 second
+}
+
+// WebhookPayload is the JSON posted for every message.
+type WebhookPayload struct {
+	ID          string               `json:"id,omitempty"`
+	RemoteAddr  string               `json:"remote_addr,omitempty"`
+	Helo        string               `json:"helo,omitempty"`
+	From        string               `json:"from"`
+	To          []string             `json:"to"`
+	ORCPT       map[string]string    `json:"orcpt,omitempty"`
+	Received    time.Time            `json:"received"`
+	Headers     textproto.MIMEHeader `json:"headers"`
+	Text        string               `json:"text,omitempty"`     // First text/plain part, decoded to UTF-8
+	HTML        string               `json:"html,omitempty"`     // First text/html part, decoded to UTF-8
+	TextRaw     *WebhookRawText      `json:"text_raw,omitempty"` // Text part in a charset that couldn't be decoded, instead of Text
+	HTMLRaw     *WebhookRawText      `json:"html_raw,omitempty"` // HTML part in a charset that couldn't be decoded, instead of HTML
+	Attachments []WebhookAttachment  `json:"attachments,omitempty"`
+}
+
+// WebhookRawText is a text part in a charset the payload can't be decoded from.
+type WebhookRawText struct {
+	Charset string `json:"charset"`
+	Content []byte `json:"content"` // base64 in the JSON
+}
+
+// WebhookAttachment is an attachment of a message. In multipart requests Content
+// is left out and Field names the form file part holding it.
+type WebhookAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content,omitempty"` // base64 in the JSON
+	Field       string `json:"field,omitempty"`
+}
+
+var (
+	errWebhookRejected = &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Message rejected"}
+	errWebhookFailed   = &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Temporary failure delivering message, please try again later"}
+)
+
+// Deliver parses the message and posts it to the webhook.
+func (wh *Webhook) Deliver(env *Envelope, msg io.Reader) error {
+	payload, err := newWebhookPayload(env, msg)
+	if err != nil {
+		return err
+	}
+	body, contentType, err := wh.encode(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := wh.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err = wh.post(body, contentType)
+		if err != errWebhookFailed || attempt >= wh.Retries {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Post the request once, mapping the outcome to a reply.
+func (wh *Webhook) post(body []byte, contentType string) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if wh.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(wh.Secret, timestamp, body))
+	}
+
+	client := wh.Client
+	if client == nil {
+		timeout := wh.Timeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errWebhookFailed
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return errWebhookFailed
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return errWebhookRejected
+	}
+	return errWebhookFailed
+}
+
+// Encode the payload as JSON, or as multipart/form-data with a "payload" field
+// and one file part per attachment.
+func (wh *Webhook) encode(payload *WebhookPayload) (body []byte, contentType string, err error) {
+	if !wh.Multipart {
+		body, err = json.Marshal(payload)
+		return body, "application/json", err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	files := make([][]byte, len(payload.Attachments))
+	for i := range payload.Attachments {
+		a := &payload.Attachments[i]
+		files[i], a.Content = a.Content, nil
+		a.Field = fmt.Sprintf("attachment%d", i+1)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="payload"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err == nil {
+		_, err = part.Write(data)
+	}
+	for i, a := range payload.Attachments {
+		if err != nil {
+			break
+		}
+		filename := a.Filename
+		if filename == "" {
+			filename = a.Field
+		}
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {fmt.Sprintf(`form-data; name="%s"; filename="%s"`, a.Field, escapeQuotes(filename))},
+			"Content-Type":        {a.ContentType},
+		})
+		if err == nil {
+			_, err = part.Write(files[i])
+		}
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	return buf.Bytes(), mw.FormDataContentType(), err
+}
+
+// WebhookSignature computes the signature of a webhook request, for verifying
+// requests on the receiving end.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookPayload(env *Envelope, msg io.Reader) (*WebhookPayload, error) {
+	payload := &WebhookPayload{
+		ID:       env.ID,
+		Helo:     env.Helo,
+		From:     env.From,
+		To:       env.To,
+		ORCPT:    env.ORCPT,
+		Received: env.Received,
+	}
+	if env.RemoteAddr != nil {
+		payload.RemoteAddr = env.RemoteAddr.String()
+	}
+	if payload.Received.IsZero() {
+		payload.Received = time.Now()
+	}
+
+	raw, err := ioutil.ReadAll(msg)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := splitMessage(raw)
+	payload.Headers = textproto.MIMEHeader{}
+	for _, f := range fields {
+		payload.Headers.Add(f.Name, decodeHeader(strings.Replace(f.Value, "\r\n", "", -1)))
+	}
+
+	// The first text and HTML parts are the message, everything else is attached.
+	err = walkMessage(bytes.NewReader(raw), func(p *mimePart) error {
+		b, err := ioutil.ReadAll(p.Body)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !p.Attachment() && p.MediaType == "text/plain" && payload.Text == "" && payload.TextRaw == nil:
+			payload.Text, payload.TextRaw = webhookText(p.Params["charset"], b)
+		case !p.Attachment() && p.MediaType == "text/html" && payload.HTML == "" && payload.HTMLRaw == nil:
+			payload.HTML, payload.HTMLRaw = webhookText(p.Params["charset"], b)
+		default:
+			payload.Attachments = append(payload.Attachments, WebhookAttachment{
+				Filename:    p.Filename,
+				ContentType: p.MediaType,
+				ContentID:   p.Header.Get("Content-Id"),
+				Size:        len(b),
+				Content:     b,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Decode a text part to UTF-8, or keep it raw if its charset isn't known.
+func webhookText(charset string, b []byte) (string, *WebhookRawText) {
+	text, ok := decodeCharset(charset, b)
+	if !ok {
+		return "", &WebhookRawText{Charset: charset, Content: b}
+	}
+	return text, nil
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Quote a header parameter value, dropping control characters so the value
+// can't end the header line.
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(stripControl(s))
+}
@@ -0,0 +1,202 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const webhookMessage = "From: sender@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Caf\xc3\xa9</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+func TestWebhookJSON(t *testing.T) {
+	var payload WebhookPayload
+	var signature, timestamp string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		timestamp = r.Header.Get("X-Webhook-Timestamp")
+		signature = strings.TrimPrefix(r.Header.Get("X-Webhook-Signature"), "sha256=")
+		if signature != WebhookSignature("secret", timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	wh := &Webhook{URL: ts.URL, Secret: "secret"}
+	env := &Envelope{From: "sender@example.com", To: []string{"recipient@example.com"}}
+	err := wh.Deliver(env, strings.NewReader(webhookMessage))
+	if err != nil {
+		t.Fatalf("Deliver returned %v", err)
+	}
+
+	if payload.From != env.From || payload.To[0] != env.To[0] || payload.Headers.Get("Subject") != "Report" {
+		t.Errorf("Payload envelope %+v", payload)
+	}
+	if strings.TrimSpace(payload.Text) != "Café" || strings.TrimSpace(payload.HTML) != "<p>Café</p>" {
+		t.Errorf("Payload text %q, html %q", payload.Text, payload.HTML)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Filename != "report.pdf" || string(payload.Attachments[0].Content) != "%PDF-1.4" {
+		t.Errorf("Payload attachments %+v", payload.Attachments)
+	}
+}
+
+func TestWebhookMultipart(t *testing.T) {
+	var payload WebhookPayload
+	var file string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.Unmarshal([]byte(r.FormValue("payload")), &payload)
+		f, header, err := r.FormFile("attachment1")
+		if err == nil {
+			b, _ := ioutil.ReadAll(f)
+			file = header.Filename + ":" + string(b)
+		}
+	}))
+	defer ts.Close()
+
+	wh := &Webhook{URL: ts.URL, Multipart: true}
+	err := wh.Deliver(&Envelope{}, strings.NewReader(webhookMessage))
+	if err != nil {
+		t.Fatalf("Deliver returned %v", err)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Field != "attachment1" || payload.Attachments[0].Content != nil {
+		t.Errorf("Payload attachments %+v", payload.Attachments)
+	}
+	if file != "report.pdf:%PDF-1.4" {
+		t.Errorf("Attachment part %q", file)
+	}
+}
+
+func TestWebhookCharsets(t *testing.T) {
+	msg := "Subject: =?iso-8859-1?q?Caf=E9?= =?utf-8?b?4oKs?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"\r\n" +
+		"Caf\xe9\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=x-unknown\r\n" +
+		"\r\n" +
+		"<p>\xe9</p>\r\n" +
+		"--b--\r\n"
+	payload, err := newWebhookPayload(&Envelope{}, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payload.Headers.Get("Subject"); got != "Café€" {
+		t.Errorf("Subject %q, want decoded", got)
+	}
+	if strings.TrimSpace(payload.Text) != "Café" {
+		t.Errorf("Text %q, want decoded from ISO-8859-1", payload.Text)
+	}
+	if payload.HTML != "" || payload.HTMLRaw == nil || payload.HTMLRaw.Charset != "x-unknown" || string(payload.HTMLRaw.Content) != "<p>\xe9</p>" {
+		t.Errorf("HTML %q, raw %+v, want the raw part for an unknown charset", payload.HTML, payload.HTMLRaw)
+	}
+
+	if got, _ := decodeCharset("windows-1252", []byte("\x80 \x93x\x94")); got != "€ “x”" {
+		t.Errorf("windows-1252 decoded to %q", got)
+	}
+}
+
+func TestWebhookFilenameInjection(t *testing.T) {
+	msg := "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?a=0D=0AX-Injected:_1=0D=0A.pdf?=\"\r\n" +
+		"\r\n" +
+		"%PDF\r\n" +
+		"--b--\r\n"
+
+	var filename, injected string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if files := r.MultipartForm.File["attachment1"]; len(files) == 1 {
+			filename = files[0].Filename
+			injected = files[0].Header.Get("X-Injected")
+		}
+	}))
+	defer ts.Close()
+
+	wh := &Webhook{URL: ts.URL, Multipart: true}
+	err := wh.Deliver(&Envelope{}, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Deliver returned %v", err)
+	}
+	if filename != "aX-Injected: 1.pdf" || injected != "" {
+		t.Errorf("Attachment part filename %q, X-Injected %q", filename, injected)
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		code     int
+		attempts int
+	}{
+		{http.StatusOK, 0, 1},
+		{http.StatusBadRequest, 550, 1},
+		{http.StatusTooManyRequests, 451, 3},
+		{http.StatusServiceUnavailable, 451, 3},
+	}
+
+	for _, tt := range tests {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tt.status)
+		}))
+
+		wh := &Webhook{URL: ts.URL, Retries: 2, RetryDelay: 1}
+		err := wh.Deliver(&Envelope{}, strings.NewReader("Subject: test\r\n\r\nBody\r\n"))
+		ts.Close()
+
+		code := 0
+		if e, ok := err.(*Error); ok {
+			code = e.Code
+		} else if err != nil {
+			t.Errorf("HTTP %d: Deliver returned %v", tt.status, err)
+		}
+		if code != tt.code || attempts != tt.attempts {
+			t.Errorf("HTTP %d: reply %d after %d attempts, want %d after %d", tt.status, code, attempts, tt.code, tt.attempts)
+		}
+	}
+}